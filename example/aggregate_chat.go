@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func main() {
+	c := api.Client{
+		Endpoint:          api.DefaultURL,
+		WebsocketEndpoint: api.DefaultURLWebsocket,
+	}
+
+	a := api.NewAggregator(&c, api.WithMessageTypes(api.MessageTypeText))
+
+	for _, streamer := range []string{"dlive-21641280", "dlive-00431789"} {
+		if err := a.Join(streamer); err != nil {
+			log.Fatalf("unable to join %s's chat: %s\n", streamer, err)
+		}
+	}
+
+	count := 0
+
+	for m := range a.Messages() {
+		count++
+		fmt.Printf("[%s] %s: %s\n", m.Streamer, m.Sender.Displayname, m.Content)
+		if count >= 10 {
+			log.Println("closing aggregator...")
+			go a.Close()
+		}
+	}
+}
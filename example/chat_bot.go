@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+	"github.com/Dak425/dlive/pkg/bot"
+)
+
+func main() {
+	c := api.Client{
+		Endpoint:          api.DefaultURL,
+		WebsocketEndpoint: api.DefaultURLWebsocket,
+		Auth:              "ADD AUTH TOKEN HERE",
+	}
+
+	streamer := "STREAMER ID HERE (Lino Account ID)"
+
+	r := bot.NewRouter(bot.Chat{
+		Sender:   &c,
+		Streamer: streamer,
+		RoomRole: api.RoomRoleModerator,
+	})
+	r.Self = "BOT USERNAME HERE"
+
+	err := r.Handle(bot.Command{
+		Name:         "hello",
+		Aliases:      []string{"hi"},
+		UserCooldown: 30 * time.Second,
+		Handler: func(ctx *bot.CommandContext) error {
+			return ctx.Reply("Hello " + ctx.Message.Sender.Displayname + "!")
+		},
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := c.StreamMessageFeed(api.StreamMessageFeedArgs{Streamer: streamer}, api.WithMessageTypes(api.MessageTypeText))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = bot.Run(context.Background(), s, func(m api.StreamMessage) {
+		r.HandleMessage(m)
+	})
+
+	log.Println("chat bot stopped:", err)
+}
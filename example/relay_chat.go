@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/Dak425/dlive/pkg/api"
+	"github.com/Dak425/dlive/pkg/bot"
+)
+
+func main() {
+	c := api.Client{
+		Endpoint:          api.DefaultURL,
+		WebsocketEndpoint: api.DefaultURLWebsocket,
+		Auth:              "ADD AUTH TOKEN HERE",
+	}
+
+	streamers := []string{"FIRST STREAMER HERE", "SECOND STREAMER HERE"}
+
+	a := api.NewAggregator(&c, api.WithMessageTypes(api.MessageTypeText))
+	defer a.Close()
+
+	for _, streamer := range streamers {
+		if err := a.Join(streamer); err != nil {
+			log.Fatalf("unable to join %s's chat: %s\n", streamer, err)
+		}
+	}
+
+	ctx := context.Background()
+
+	q := bot.NewChatQueue(&c)
+	go q.Run(ctx)
+
+	r := bot.NewRelay(q, streamers...)
+	r.Self = "BOT USERNAME HERE"
+	r.SkipCommands = bot.DefaultPrefix
+
+	err := r.Run(ctx, a.Messages())
+
+	log.Println("chat relay stopped:", err)
+}
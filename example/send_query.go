@@ -11,7 +11,7 @@ import (
 func main() {
 	c := api.Client{
 		Endpoint: api.DefaultURL,
-		Feeds:    make(map[string]api.Feed),
+		Feeds:    make(map[string]*api.Feed),
 	}
 
 	resp, err := c.GlobalInformation()
@@ -11,13 +11,13 @@ import (
 func main() {
 	c := Client{
 		Endpoint: DefaultURL,
-		Feeds:    make(map[string]Feed),
+		Feeds:    make(map[string]*Feed),
 	}
 
 	rc := make(chan Response)
 
-	go func(responseChan chan<- Response, client Client) {
-		resp, err := c.GlobalInformation()
+	go func(responseChan chan<- Response, client *Client) {
+		resp, err := client.GlobalInformation()
 
 		if err != nil {
 			log.Fatalf("error when sending query, %s\n", err)
@@ -28,7 +28,7 @@ func main() {
 		close(responseChan)
 
 		return
-	}(rc, c)
+	}(rc, &c)
 
 	resp := <-rc
 
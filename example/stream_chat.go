@@ -11,7 +11,7 @@ func main() {
 	c := api.Client{
 		Endpoint:          api.DefaultURL,
 		WebsocketEndpoint: api.DefaultURLWebsocket,
-		Feeds:             make(map[string]api.Feed),
+		Feeds:             make(map[string]*api.Feed),
 	}
 
 	args := api.StreamMessageFeedArgs{
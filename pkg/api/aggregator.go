@@ -0,0 +1,280 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AggregatedMessage is a chat event received by an Aggregator, tagged with the streamer whose chat it came from
+type AggregatedMessage struct {
+	Streamer string // The streamer whose chat the event was sent in
+	StreamMessage
+}
+
+// ChannelHealth describes the state of one of an Aggregator's channels
+type ChannelHealth struct {
+	Streamer  string    // The streamer whose chat is being watched
+	Connected bool      // If the channel's feed is still delivering events
+	JoinedAt  time.Time // When the channel was joined
+	LastEvent time.Time // When the last event was received, zero if none have been
+	Events    int       // How many events have been received
+	Err       error     // Why the channel's subscription ended, nil while connected
+}
+
+// aggregatorChannel is a single streamer's chat being watched by an Aggregator
+type aggregatorChannel struct {
+	subscription *Subscription // Nil while joining
+	joining      bool          // Set while the streamer's feed is being started
+	stop         chan struct{} // Closed when the channel is left
+	health       ChannelHealth
+}
+
+// Aggregator merges the chat events of many streamers into a single stream
+// Streamers can be joined and left at any time, each one has its own feed on the Client
+type Aggregator struct {
+	client   *Client
+	opts     []SubscribeOption // Options used when subscribing to each streamer's feed
+	messages chan AggregatedMessage
+	mu       sync.Mutex // Guards channels and closed
+	channels map[string]*aggregatorChannel
+	closed   bool
+	wg       sync.WaitGroup // Tracks the goroutines reading each channel's subscription
+}
+
+// NewAggregator creates an Aggregator that subscribes to feeds using the given client and options
+func NewAggregator(c *Client, opts ...SubscribeOption) *Aggregator {
+	return &Aggregator{
+		client:   c,
+		opts:     opts,
+		messages: make(chan AggregatedMessage),
+		channels: make(map[string]*aggregatorChannel),
+	}
+}
+
+// Messages gives the merged chat events of every joined streamer
+// The channel is closed once the Aggregator is closed
+func (a *Aggregator) Messages() <-chan AggregatedMessage {
+	return a.messages
+}
+
+// Join starts receiving chat events from the given streamer
+// Joining a streamer whose channel has stopped will rejoin it
+// Returns an error if the streamer has already been joined, or their feed could not be started
+// The streamer's feed is started without holding up the other channels
+func (a *Aggregator) Join(streamer string) error {
+	a.mu.Lock()
+
+	if a.closed {
+		a.mu.Unlock()
+		return errors.New("aggregator has been closed")
+	}
+
+	var stopped *Subscription
+
+	if ch, ok := a.channels[streamer]; ok {
+		if ch.joining || ch.health.Connected {
+			a.mu.Unlock()
+			return fmt.Errorf("already joined streamer (%s)", streamer)
+		}
+
+		stopped = a.leave(streamer)
+	}
+
+	// Hold the streamer's place while their feed starts
+	ch := &aggregatorChannel{
+		joining: true,
+		stop:    make(chan struct{}),
+		health:  ChannelHealth{Streamer: streamer},
+	}
+
+	a.channels[streamer] = ch
+
+	a.mu.Unlock()
+
+	if stopped != nil {
+		stopped.Close()
+	}
+
+	s, err := a.client.StreamMessageFeed(StreamMessageFeedArgs{Streamer: streamer}, a.opts...)
+
+	a.mu.Lock()
+
+	// The streamer was left, or the aggregator closed, while their feed started
+	if a.channels[streamer] != ch {
+		a.mu.Unlock()
+
+		if err == nil {
+			s.Close()
+		}
+
+		return fmt.Errorf("streamer (%s) was left while joining", streamer)
+	}
+
+	if err != nil {
+		delete(a.channels, streamer)
+		a.mu.Unlock()
+		return err
+	}
+
+	ch.subscription = s
+	ch.joining = false
+	ch.health.Connected = true
+	ch.health.JoinedAt = time.Now()
+
+	a.wg.Add(1)
+	go a.read(ch)
+
+	a.mu.Unlock()
+
+	a.client.logger().Info("aggregator joined streamer", "streamer", streamer)
+
+	return nil
+}
+
+// Leave stops receiving chat events from the given streamer, closing its subscription
+// Returns an error if the streamer was never joined
+func (a *Aggregator) Leave(streamer string) error {
+	a.mu.Lock()
+
+	if _, ok := a.channels[streamer]; !ok {
+		a.mu.Unlock()
+		return fmt.Errorf("streamer (%s) has not been joined", streamer)
+	}
+
+	s := a.leave(streamer)
+
+	a.mu.Unlock()
+
+	if s != nil {
+		s.Close()
+	}
+
+	return nil
+}
+
+// leave removes the streamer's channel, the aggregator's lock must be held
+// Returns the channel's subscription, for the caller to close once the lock is released
+func (a *Aggregator) leave(streamer string) *Subscription {
+	ch := a.channels[streamer]
+
+	close(ch.stop)
+	delete(a.channels, streamer)
+
+	a.client.logger().Info("aggregator left streamer", "streamer", streamer)
+
+	return ch.subscription
+}
+
+// Streamers gives every joined streamer in alphabetical order, leaving out any still joining
+func (a *Aggregator) Streamers() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	streamers := make([]string, 0, len(a.channels))
+
+	for k, ch := range a.channels {
+		if !ch.joining {
+			streamers = append(streamers, k)
+		}
+	}
+
+	sort.Strings(streamers)
+
+	return streamers
+}
+
+// Health reports the state of every joined streamer's channel in alphabetical order, leaving out any still joining
+func (a *Aggregator) Health() []ChannelHealth {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	health := make([]ChannelHealth, 0, len(a.channels))
+
+	for _, ch := range a.channels {
+		if !ch.joining {
+			health = append(health, ch.health)
+		}
+	}
+
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Streamer < health[j].Streamer
+	})
+
+	return health
+}
+
+// Close leaves every streamer, waits for their events to stop being read, then closes the Messages channel
+func (a *Aggregator) Close() {
+	a.mu.Lock()
+
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+
+	a.closed = true
+
+	var subscriptions []*Subscription
+
+	for k := range a.channels {
+		if s := a.leave(k); s != nil {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+
+	a.mu.Unlock()
+
+	for _, s := range subscriptions {
+		s.Close()
+	}
+
+	a.wg.Wait()
+
+	close(a.messages)
+}
+
+// read forwards the channel's chat events to the merged stream until the channel is left or its feed ends
+func (a *Aggregator) read(ch *aggregatorChannel) {
+	defer a.wg.Done()
+
+	streamer := ch.health.Streamer
+
+	for m := range ch.subscription.Messages {
+		messages, err := DecodeStreamMessages(m)
+
+		if err != nil {
+			continue
+		}
+
+		for _, message := range messages {
+			a.mu.Lock()
+			ch.health.Events++
+			ch.health.LastEvent = time.Now()
+			a.mu.Unlock()
+
+			select {
+			case a.messages <- AggregatedMessage{Streamer: streamer, StreamMessage: message}:
+			case <-ch.stop:
+				return
+			}
+		}
+	}
+
+	<-ch.subscription.Done()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-ch.stop:
+		// Left on purpose, nothing to report
+	default:
+		ch.health.Connected = false
+		ch.health.Err = ch.subscription.Err()
+
+		a.client.logger().Warn("aggregator channel stopped", "streamer", streamer, logKeyError, ch.health.Err)
+	}
+}
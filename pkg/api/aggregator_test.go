@@ -0,0 +1,176 @@
+package api
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chatServer is a graphql-ws server that sends a single chat event for each stream message subscription
+// The event's content is the streamer the subscription was for
+// If hold is given, it is called with the number of each connection, starting at 1, before the connection is acknowledged
+func chatServer(t *testing.T, hold func(n int32)) *testSocket {
+	ts := &testSocket{}
+
+	var connections int32
+
+	ts.serve(t, func(conn *websocket.Conn) {
+		var init WebSocketRequest
+
+		if err := conn.ReadJSON(&init); err != nil {
+			return
+		}
+
+		if hold != nil {
+			hold(atomic.AddInt32(&connections, 1))
+		}
+
+		conn.WriteJSON(FeedMessage{MessageType: connectionAckMessage})
+
+		var start struct {
+			Payload struct {
+				Variables StreamMessageFeedArgs `json:"variables"`
+			} `json:"payload"`
+		}
+
+		if err := conn.ReadJSON(&start); err != nil {
+			return
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"data","payload":{"data":{"streamMessageReceived":[{"type":"Message","content":"`+start.Payload.Variables.Streamer+`"}]}}}`))
+
+		// Hold the connection open until the client leaves
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	return ts
+}
+
+func TestAggregator(t *testing.T) {
+	ts := chatServer(t, nil)
+	defer ts.Close()
+
+	c := &Client{
+		WebsocketEndpoint: ts.url(),
+	}
+
+	a := NewAggregator(c)
+
+	for _, streamer := range []string{"one", "two"} {
+		if err := a.Join(streamer); err != nil {
+			t.Fatal("unable to join streamer: ", err)
+		}
+	}
+
+	if err := a.Join("one"); err == nil {
+		t.Error("joining a streamer twice should return an error")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-a.Messages():
+			if m.Streamer != m.Content {
+				t.Errorf("event sent in %s's chat was tagged with %s", m.Content, m.Streamer)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event never reached the aggregator")
+		}
+	}
+
+	for _, h := range a.Health() {
+		if !h.Connected || h.Events != 1 {
+			t.Errorf("channel %s should be connected with 1 event, connected %t with %d events", h.Streamer, h.Connected, h.Events)
+		}
+	}
+
+	if err := a.Leave("one"); err != nil {
+		t.Error("unable to leave streamer: ", err)
+	}
+
+	if count := c.FeedCount(); count != 1 {
+		t.Errorf("client should have 1 feed after leaving a streamer, has %d", count)
+	}
+
+	a.Close()
+
+	if _, ok := <-a.Messages(); ok {
+		t.Error("messages channel should be closed after the aggregator is closed")
+	}
+
+	if count := c.FeedCount(); count != 0 {
+		t.Errorf("client should have no feeds after the aggregator is closed, has %d", count)
+	}
+}
+
+func TestAggregator_SlowJoin(t *testing.T) {
+	release := make(chan struct{})
+	holding := make(chan struct{})
+
+	ts := chatServer(t, func(n int32) {
+		if n > 1 {
+			close(holding)
+			<-release
+		}
+	})
+	defer ts.Close()
+
+	c := &Client{
+		WebsocketEndpoint: ts.url(),
+	}
+
+	a := NewAggregator(c)
+	defer a.Close()
+
+	if err := a.Join("fast"); err != nil {
+		t.Fatal("unable to join streamer: ", err)
+	}
+
+	joined := make(chan error, 1)
+
+	go func() {
+		joined <- a.Join("slow")
+	}()
+
+	<-holding
+
+	if err := a.Join("slow"); err == nil {
+		t.Error("a streamer still joining should not be joined again")
+	}
+
+	if s := a.Streamers(); len(s) != 1 || s[0] != "fast" {
+		t.Errorf("a streamer still joining should not be listed, got %v", s)
+	}
+
+	select {
+	case m := <-a.Messages():
+		if m.Streamer != "fast" {
+			t.Errorf("expected an event from fast, got one from %s", m.Streamer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow join should not hold up other channels")
+	}
+
+	if h := a.Health(); len(h) != 1 || !h[0].Connected {
+		t.Errorf("expected only fast in health, got %+v", h)
+	}
+
+	if err := a.Leave("slow"); err != nil {
+		t.Error("unable to leave a streamer while joining: ", err)
+	}
+
+	close(release)
+
+	if err := <-joined; err == nil {
+		t.Error("a join should fail when the streamer is left while joining")
+	}
+
+	if count := c.FeedCount(); count != 1 {
+		t.Errorf("client should have 1 feed after the slow join was abandoned, has %d", count)
+	}
+}
@@ -2,12 +2,14 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,21 +20,49 @@ const DefaultURLWebsocket = "wss://graphigostream.prd.dlive.tv/"
 
 // Client is used to send requests to DLive's API
 type Client struct {
-	Endpoint          string          // The endpoint for DLive's API
-	WebsocketEndpoint string          // The endpoint used for making websocket connections
-	Auth              string          // An authorization token to send along with requests
-	Feeds             map[string]Feed // Any active websocket streams the client is consuming
+	Endpoint          string           // The endpoint for DLive's API
+	WebsocketEndpoint string           // The endpoint used for making websocket connections
+	Auth              string           // An authorization token to send along with requests
+	Protocol          string           // The websocket subprotocol used by feeds, defaults to ProtocolGraphQLWS
+	HistorySize       int              // How many recent chat events each feed keeps for replay, see Feed.SetHistory
+	HistoryAge        time.Duration    // How long each feed keeps recent chat events for replay, see Feed.SetHistory
+	Logger            Logger           // Where the client and its feeds report what they are doing, silent if nil
+	OnSend            SendHook         // Called with the outcome of every request made by Send, if set, use SendHooks for more than one
+	Feeds             map[string]*Feed // Any active websocket streams the client is consuming
+	feedsMu           sync.Mutex       // Guards Feeds, routines and closed
+	routines          *routines        // Tracks the goroutines started for every feed
+	closed            bool             // Set once Close has been called
+}
+
+// SendHook is given each request a Client sends, along with its response or error
+type SendHook func(req Request, resp Response, err error)
+
+// SendHooks combines hooks into a single SendHook that calls each of them in order, nil hooks are skipped
+func SendHooks(hooks ...SendHook) SendHook {
+	return func(req Request, resp Response, err error) {
+		for _, h := range hooks {
+			if h != nil {
+				h(req, resp, err)
+			}
+		}
+	}
 }
 
 func (c *Client) Feed(key string) (*Feed, error) {
+	c.feedsMu.Lock()
+	defer c.feedsMu.Unlock()
+
 	if f, ok := c.Feeds[key]; ok {
-		return &f, nil
+		return f, nil
 	} else {
 		return nil, errors.New(fmt.Sprintf("no active feed found with key (%s)", key))
 	}
 }
 
 func (c *Client) FeedCount() int {
+	c.feedsMu.Lock()
+	defer c.feedsMu.Unlock()
+
 	return len(c.Feeds)
 }
 
@@ -54,7 +84,7 @@ func (c *Client) MeGlobal() (Response, error) {
 func (c *Client) MeDashboard(args MeDashboardArgs) (Response, error) {
 	req := Request{
 		Query: MeDashboardQuery(),
-		Vars: args,
+		Vars:  args,
 	}
 	return c.Send(req)
 }
@@ -62,7 +92,7 @@ func (c *Client) MeDashboard(args MeDashboardArgs) (Response, error) {
 func (c *Client) MeLivestream(args MeLivestreamArgs) (Response, error) {
 	req := Request{
 		Query: MeLivestreamQuery(),
-		Vars: args,
+		Vars:  args,
 	}
 	return c.Send(req)
 }
@@ -70,7 +100,7 @@ func (c *Client) MeLivestream(args MeLivestreamArgs) (Response, error) {
 func (c *Client) MeSubscribing(args MeSubscribingArgs) (Response, error) {
 	req := Request{
 		Query: MeSubscribingQuery(),
-		Vars: args,
+		Vars:  args,
 	}
 	return c.Send(req)
 }
@@ -187,53 +217,194 @@ func (c *Client) SendStreamChat(args SendStreamChatMessageArgs) (Response, error
 	return c.Send(req)
 }
 
-// Subscription Methods
-func (c *Client) StreamMessageFeed(args StreamMessageFeedArgs) (*Subscription, error) {
-	k := "StreamMessageFeed:" + args.Streamer
+func (c *Client) DeleteChat(args DeleteChatArgs) (Response, error) {
+	req := Request{
+		Query: DeleteChatMutation(),
+		Vars:  args,
+	}
+	return c.Send(req)
+}
 
-	if f, ok := c.Feeds[k]; ok {
-		if f.Active() {
-			return f.Subscribe()
-		}
-	} else {
-		c.Feeds[k] = Feed{
-			key: k,
-			subscriptions: make(map[string]chan<- []byte),
-		}
+func (c *Client) BanStreamChatUser(args BanStreamChatUserArgs) (Response, error) {
+	req := Request{
+		Query: BanStreamChatUserMutation(),
+		Vars:  args,
+	}
+	return c.Send(req)
+}
+
+func (c *Client) UnbanStreamChatUser(args UnbanStreamChatUserArgs) (Response, error) {
+	req := Request{
+		Query: UnbanStreamChatUserMutation(),
+		Vars:  args,
+	}
+	return c.Send(req)
+}
+
+func (c *Client) AddModerator(args AddModeratorArgs) (Response, error) {
+	req := Request{
+		Query: AddModeratorMutation(),
+		Vars:  args,
+	}
+	return c.Send(req)
+}
+
+func (c *Client) RemoveModerator(args RemoveModeratorArgs) (Response, error) {
+	req := Request{
+		Query: RemoveModeratorMutation(),
+		Vars:  args,
 	}
+	return c.Send(req)
+}
 
-	f := c.Feeds[k]
+func (c *Client) SetChatInterval(args SetChatIntervalArgs) (Response, error) {
+	req := Request{
+		Query: SetChatIntervalMutation(),
+		Vars:  args,
+	}
+	return c.Send(req)
+}
+
+// Subscription Methods
+func (c *Client) StreamMessageFeed(args StreamMessageFeedArgs, opts ...SubscribeOption) (*Subscription, error) {
+	k := "StreamMessageFeed:" + args.Streamer
 
 	r := WebSocketRequest{
 		ID:   "1",
-		Type: "start",
+		Type: startMessage,
 		Payload: Request{
 			Query: StreamMessageSubscription(),
 			Vars:  args,
 		},
 	}
 
-	err := f.Start(r, c.setupWebsocket)
+	return c.subscribe(k, r, opts...)
+}
+
+// subscribe returns a new Subscription to the feed with the given key
+// If no active feed exists for the key, a new one is started using the provided request
+// Every subscription to a feed shares its websocket
+func (c *Client) subscribe(key string, req WebSocketRequest, opts ...SubscribeOption) (*Subscription, error) {
+	p, err := lookupProtocol(c.Protocol)
 
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := f.Subscribe()
+	c.feedsMu.Lock()
+
+	if c.closed {
+		c.feedsMu.Unlock()
+		return nil, ErrClientClosed
+	}
+
+	if c.Feeds == nil {
+		c.Feeds = make(map[string]*Feed)
+	}
+
+	if c.routines == nil {
+		c.routines = newRoutines()
+	}
+
+	// Feeds still being started are shared too, so concurrent callers don't open duplicate sockets
+	if f, ok := c.Feeds[key]; ok && !f.stopped() {
+		c.feedsMu.Unlock()
+		return f.Subscribe(opts...)
+	}
+
+	// Feeds can't be restarted once closed, replace any stale feed with a fresh one
+	f := newFeed(key, p)
+	f.routines = c.routines
+	f.log = c.Logger
+	f.SetHistory(c.HistorySize, c.HistoryAge)
+	f.onClose = func() {
+		c.removeFeed(key, f)
+	}
+	c.Feeds[key] = f
+
+	c.feedsMu.Unlock()
+
+	// Subscribe before starting so no data from the socket is missed
+	s, err := f.Subscribe(opts...)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err := f.Start(p.startRequest(req), c.setupWebsocket); err != nil {
+		s.Close()
+		f.Close()
+		return nil, err
+	}
+
 	return s, nil
 }
 
+// Close stops every feed the client has started, sending the protocol's stop messages and ending all subscriptions with ErrClientClosed
+// Data not yet read from subscriptions is discarded
+// Blocks until every goroutine started for the feeds has returned, or the context is done
+// Once closed, the client can no longer start feeds
+func (c *Client) Close(ctx context.Context) error {
+	c.feedsMu.Lock()
+
+	c.closed = true
+
+	feeds := make([]*Feed, 0, len(c.Feeds))
+
+	for _, f := range c.Feeds {
+		feeds = append(feeds, f)
+	}
+
+	r := c.routines
+
+	c.feedsMu.Unlock()
+
+	for _, f := range feeds {
+		f.abort(ErrClientClosed)
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	// Subscriptions of feeds that closed earlier may still be waiting on their consumer
+	r.stop(ErrClientClosed)
+
+	c.logger().Info("client closed", "feeds", len(feeds))
+
+	return r.wait(ctx)
+}
+
+// removeFeed forgets the feed with the given key, unless it has already been replaced by another feed
+func (c *Client) removeFeed(key string, f *Feed) {
+	c.feedsMu.Lock()
+	defer c.feedsMu.Unlock()
+
+	if c.Feeds[key] == f {
+		delete(c.Feeds, key)
+	}
+}
+
 // Send takes the provided request, sends it to the DLive API endpoint, then returns the decoded JSON response
 func (c *Client) Send(req Request) (Response, error) {
+	resp, err := c.send(req)
+
+	if c.OnSend != nil {
+		c.OnSend(req, resp, err)
+	}
+
+	return resp, err
+}
+
+func (c *Client) send(req Request) (Response, error) {
 	client := http.Client{}
 	var body bytes.Buffer
 	var data Response
 
+	op := operationName(req.Query)
+
+	c.logger().Debug("sending request", logKeyOperation, op)
+
 	if err := json.NewEncoder(&body).Encode(req); err != nil {
 		return data, err
 	}
@@ -254,6 +425,7 @@ func (c *Client) Send(req Request) (Response, error) {
 	resp, err := client.Do(r)
 
 	if err != nil {
+		c.logger().Warn("request failed", logKeyOperation, op, logKeyError, err)
 		return data, err
 	}
 
@@ -270,40 +442,54 @@ func (c *Client) Send(req Request) (Response, error) {
 	}
 
 	if len(data.Errors) > 0 {
+		c.logger().Warn("request returned errors", logKeyOperation, op, logKeyError, data.Errors[0])
 		return data, data.Errors[0]
 	}
 
 	return data, nil
 }
 
+// logger gives the client's Logger, or one that discards everything if none was given
+func (c *Client) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+
+	return c.Logger
+}
+
 // setupWebsocket is the default func used to setup a websocket connection for a feed
+// The connection is initialised with the client's auth token, and the request is only sent once the server has acknowledged the connection
 func (c *Client) setupWebsocket(req WebSocketRequest) (*websocket.Conn, error) {
+	p, err := lookupProtocol(c.Protocol)
+
+	if err != nil {
+		return nil, err
+	}
+
 	conn, _, err := websocket.DefaultDialer.Dial(c.WebsocketEndpoint, http.Header{
-		"Sec-WebSocket-Protocol": []string{"graphql-ws"},
+		"Sec-WebSocket-Protocol": []string{p.name},
 		"Sec-WebSocket-Version":  []string{"13"},
 	})
 
 	if err != nil {
-		log.Println("Dial:", err)
+		c.logger().Error("unable to dial websocket", "endpoint", c.WebsocketEndpoint, logKeyError, err)
 		return nil, err
 	}
 
-	init := WebSocketRequest{
-		Type:    connectionInit,
-		Payload: Request{},
-	}
-
-	err = conn.WriteJSON(init)
+	err = p.init(conn, c.Auth)
 
 	if err != nil {
-		log.Println("Connection Init:", err)
+		c.logger().Error("unable to initialise websocket connection", "protocol", p.name, logKeyError, err)
+		conn.Close()
 		return nil, err
 	}
 
 	err = conn.WriteJSON(req)
 
 	if err != nil {
-		log.Println("GraphQL Subscription Start:", err)
+		c.logger().Error("unable to start subscription", logKeyOperation, req.operation(), logKeyError, err)
+		conn.Close()
 		return nil, err
 	}
 
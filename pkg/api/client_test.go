@@ -0,0 +1,394 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientMessage is a message the client sent, as the server reads it
+type clientMessage struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// graphqlWSServer runs the server side of a GraphQL websocket connection for a single subscription
+// Each message the client sends is written to received
+func graphqlWSServer(t *testing.T, p protocol, received chan<- clientMessage, ack string) *testSocket {
+	ts := &testSocket{}
+
+	ts.serve(t, func(conn *websocket.Conn) {
+		defer close(received)
+
+		var init clientMessage
+
+		if err := conn.ReadJSON(&init); err != nil {
+			t.Error("unable to read connection init: ", err)
+			return
+		}
+
+		received <- init
+
+		if p.name == ProtocolGraphQLTransportWS {
+			conn.WriteJSON(FeedMessage{MessageType: pingMessage})
+		} else {
+			conn.WriteJSON(FeedMessage{MessageType: connectionKeepAliveMessage})
+		}
+
+		conn.WriteJSON(FeedMessage{MessageType: ack})
+
+		for {
+			var m clientMessage
+
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+
+			received <- m
+
+			if m.Type == p.start {
+				data := dataMessage
+
+				if p.name == ProtocolGraphQLTransportWS {
+					data = nextMessage
+					conn.WriteJSON(FeedMessage{MessageType: pingMessage})
+				}
+
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"`+data+`","payload":{"data":{}}}`))
+			}
+		}
+	})
+
+	return ts
+}
+
+func TestClient_StreamMessageFeed(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := graphqlWSServer(t, graphqlWS, received, connectionAckMessage)
+	defer ts.Close()
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+		Auth:              "token",
+	}
+
+	s, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"})
+
+	if err != nil {
+		t.Fatal("unable to start stream message feed: ", err)
+	}
+
+	init := <-received
+
+	if init.Type != connectionInit {
+		t.Fatalf("first message should be %s, got %s", connectionInit, init.Type)
+	}
+
+	var params map[string]string
+
+	if err := json.Unmarshal(init.Payload, &params); err != nil || params["authorization"] != "token" {
+		t.Errorf("connection init should carry the auth token, got payload %s", init.Payload)
+	}
+
+	if start := <-received; start.Type != startMessage || start.ID != "1" {
+		t.Errorf("expected start message for operation 1, got %s for %s", start.Type, start.ID)
+	}
+
+	select {
+	case <-s.Messages:
+	case <-time.After(time.Second):
+		t.Fatal("data message never reached subscriber")
+	}
+
+	s.Close()
+
+	for _, expected := range []string{stopMessage, connectionTerminate} {
+		if m := <-received; m.Type != expected {
+			t.Errorf("expected %s message after close, got %s", expected, m.Type)
+		}
+	}
+}
+
+func TestClient_StreamMessageFeedRejected(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := graphqlWSServer(t, graphqlWS, received, connectionErrorMessage)
+	defer ts.Close()
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+	}
+
+	if _, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"}); err == nil {
+		t.Error("feed should fail to start when the server rejects the connection")
+	}
+
+	if init := <-received; init.Payload != nil {
+		t.Errorf("connection init should have no payload without an auth token, got %s", init.Payload)
+	}
+}
+
+func TestClient_StreamMessageFeedCompleted(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := &testSocket{}
+
+	ts.serve(t, func(conn *websocket.Conn) {
+		defer close(received)
+
+		for {
+			var m clientMessage
+
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+
+			received <- m
+
+			switch m.Type {
+			case connectionInit:
+				conn.WriteJSON(FeedMessage{MessageType: connectionAckMessage})
+			case startMessage:
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"complete"}`))
+			}
+		}
+	})
+	defer ts.Close()
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+	}
+
+	s, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"})
+
+	if err != nil {
+		t.Fatal("unable to start stream message feed: ", err)
+	}
+
+	if _, err := s.Next(context.Background()); err != ErrFeedCompleted {
+		t.Fatalf("expected the feed to complete, got %v", err)
+	}
+
+	// The server already ended the operation, so it is not stopped
+	for _, expected := range []string{connectionInit, startMessage, connectionTerminate} {
+		if m := <-received; m.Type != expected {
+			t.Errorf("expected %s message, got %s", expected, m.Type)
+		}
+	}
+}
+
+func TestClient_StreamMessageFeedTransportWS(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := graphqlWSServer(t, graphqlTransportWS, received, connectionAckMessage)
+	defer ts.Close()
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+		Protocol:          ProtocolGraphQLTransportWS,
+	}
+
+	s, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"})
+
+	if err != nil {
+		t.Fatal("unable to start stream message feed: ", err)
+	}
+
+	// Pings sent before and after subscribing must both be answered
+	for _, expected := range []string{connectionInit, pongMessage, subscribeMessage} {
+		if m := <-received; m.Type != expected {
+			t.Fatalf("expected %s message, got %s", expected, m.Type)
+		}
+	}
+
+	select {
+	case <-s.Messages:
+	case <-time.After(time.Second):
+		t.Fatal("next message never reached subscriber")
+	}
+
+	if m := <-received; m.Type != pongMessage {
+		t.Errorf("expected %s message, got %s", pongMessage, m.Type)
+	}
+
+	s.Close()
+
+	if m := <-received; m.Type != completeMessage || m.ID != "1" {
+		t.Errorf("expected complete message for operation 1 after close, got %s for %s", m.Type, m.ID)
+	}
+}
+
+func TestClient_StreamMessageFeedUnknownProtocol(t *testing.T) {
+	c := Client{
+		Protocol: "unknown",
+	}
+
+	if _, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"}); err == nil {
+		t.Error("feed should fail to start with an unsupported protocol")
+	}
+}
+
+// The standard library's structured logger can be used directly
+var _ Logger = slog.Default()
+
+// recordingLogger keeps every message logged, formatted as the level, message, then key=value pairs
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *recordingLogger) record(level string, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := level + " " + msg
+
+	for i := 0; i+1 < len(args); i += 2 {
+		entry += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+
+	l.entries = append(l.entries, entry)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg, args) }
+
+func (l *recordingLogger) contains(entry string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range l.entries {
+		if strings.HasPrefix(e, entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestClient_Logger(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := graphqlWSServer(t, graphqlWS, received, connectionAckMessage)
+	defer ts.Close()
+
+	l := &recordingLogger{}
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+		Logger:            l,
+	}
+
+	s, err := c.StreamMessageFeed(StreamMessageFeedArgs{Streamer: "streamer"})
+
+	if err != nil {
+		t.Fatal("unable to start stream message feed: ", err)
+	}
+
+	s.Close()
+
+	expected := []string{
+		"DEBUG subscription added feed=StreamMessageFeed:streamer subscription=" + s.Key,
+		"INFO feed started feed=StreamMessageFeed:streamer operation=StreamMessageSubscription",
+		"INFO feed closed feed=StreamMessageFeed:streamer operation=StreamMessageSubscription reason=" + ErrFeedClosed.Error(),
+	}
+
+	for _, e := range expected {
+		if !l.contains(e) {
+			t.Errorf("expected log entry --%s--, got %v", e, l.entries)
+		}
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	queries := map[string]string{
+		StreamMessageSubscription():     "StreamMessageSubscription",
+		SendStreamChatMessageMutation(): "SendStreamChatMessage",
+		"{ me { id } }":                 "",
+		"query($id: String!) { user }":  "",
+	}
+
+	for q, expected := range queries {
+		if name := operationName(q); name != expected {
+			t.Errorf("expected operation name --%s--, got --%s--", expected, name)
+		}
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	received := make(chan clientMessage, 10)
+
+	ts := graphqlWSServer(t, graphqlWS, received, connectionAckMessage)
+	defer ts.Close()
+
+	c := Client{
+		WebsocketEndpoint: ts.url(),
+	}
+
+	args := StreamMessageFeedArgs{Streamer: "streamer"}
+
+	reader, err := c.StreamMessageFeed(args)
+
+	if err != nil {
+		t.Fatal("unable to start stream message feed: ", err)
+	}
+
+	// Never read from, so its delivery goroutine is left waiting on the consumer
+	idle, _ := c.StreamMessageFeed(args)
+
+	<-reader.Messages
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal("client did not close cleanly: ", err)
+	}
+
+	for _, expected := range []string{connectionInit, startMessage, stopMessage, connectionTerminate} {
+		if m := <-received; m.Type != expected {
+			t.Errorf("expected %s message, got %s", expected, m.Type)
+		}
+	}
+
+	for _, s := range []*Subscription{reader, idle} {
+		if err := s.Err(); err != ErrClientClosed {
+			t.Errorf("subscription should end with %v, got %v", ErrClientClosed, err)
+		}
+	}
+
+	if _, err := c.StreamMessageFeed(args); err != ErrClientClosed {
+		t.Errorf("starting a feed after close should give %v, got %v", ErrClientClosed, err)
+	}
+
+	if count := c.FeedCount(); count != 0 {
+		t.Errorf("client should have no feeds after close, has %d", count)
+	}
+}
+
+func TestSendHooks(t *testing.T) {
+	var called []string
+
+	hook := SendHooks(
+		func(req Request, resp Response, err error) { called = append(called, "first "+req.Query) },
+		nil,
+		func(req Request, resp Response, err error) { called = append(called, "second "+req.Query) },
+	)
+
+	hook(Request{Query: "query"}, Response{}, nil)
+
+	if len(called) != 2 || called[0] != "first query" || called[1] != "second query" {
+		t.Errorf("expected both hooks called in order, got %v", called)
+	}
+}
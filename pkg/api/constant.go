@@ -12,4 +12,25 @@ const ContributionSummaryAll = "ALL_TIME"
 
 // Sorting
 const SortAlpha = "AZ"
-const SortTrending = "Trending"
\ No newline at end of file
+const SortTrending = "Trending"
+
+// Chat Message Types
+const MessageTypeText = "Message"
+const MessageTypeGift = "Gift"
+const MessageTypeSubscription = "Subscription"
+const MessageTypeFollow = "Follow"
+const MessageTypeHost = "Host"
+const MessageTypeChangeMode = "ChangeMode"
+const MessageTypeDelete = "Delete"
+const MessageTypeBan = "Ban"
+const MessageTypeModerator = "Mod"
+const MessageTypeEmoteAdd = "Emote"
+const MessageTypeLive = "Live"
+const MessageTypeOffline = "Offline"
+
+// Gift Types
+const GiftLemon = "LEMON"
+const GiftIceCream = "ICE_CREAM"
+const GiftDiamond = "DIAMOND"
+const GiftNinjaghini = "NINJAGHINI"
+const GiftNinjet = "NINJET"
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Reasons a Subscription can end, given by Subscription.Err
+var (
+	ErrUnsubscribed  = errors.New("subscription was closed")          // The consumer closed the subscription
+	ErrFeedClosed    = errors.New("feed was closed")                  // The feed was closed locally
+	ErrFeedCompleted = errors.New("feed was completed by the server") // The server finished the operation normally
+)
+
+// GraphQLError is an error the server sent for a feed's operation
+type GraphQLError struct {
+	Messages []string // The message of each error the server gave
+}
+
+func (e *GraphQLError) Error() string {
+	return "DLive API Error: " + strings.Join(e.Messages, "; ")
+}
+
+// newGraphQLError decodes the payload of an error message, which is a single error or a list of them
+func newGraphQLError(payload json.RawMessage) *GraphQLError {
+	var list []responseError
+
+	if err := json.Unmarshal(payload, &list); err != nil {
+		var single responseError
+
+		if err := json.Unmarshal(payload, &single); err != nil || single.Message == "" {
+			return &GraphQLError{Messages: []string{string(payload)}}
+		}
+
+		list = []responseError{single}
+	}
+
+	e := &GraphQLError{}
+
+	for _, r := range list {
+		e.Messages = append(e.Messages, r.Message)
+	}
+
+	return e
+}
+
+// ConnectionError is a failure of a feed's websocket
+type ConnectionError struct {
+	Err error // The underlying socket error
+}
+
+func (e *ConnectionError) Error() string {
+	return "feed connection failed: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ErrClientClosed is given when using a Client after it has been closed, and ends every subscription open at the time
+var ErrClientClosed = errors.New("client was closed")
+
+// MutationError is an error DLive reported in the payload of a mutation, rather than as a GraphQL error
+type MutationError struct {
+	Field   string // The mutation field the error was reported in, such as sendStreamchatMessage
+	Code    int    // DLive's error code
+	Message string // DLive's error message, not every mutation gives one
+}
+
+func (e *MutationError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("DLive API Error: %s failed with code %d", e.Field, e.Code)
+	}
+
+	return fmt.Sprintf("DLive API Error: %s failed with code %d: %s", e.Field, e.Code, e.Message)
+}
+
+// MutationError gives the error reported in the err field of the given mutation's payload, or nil if there wasn't one
+func (r Response) MutationError(field string) error {
+	payload, ok := r.Data[field].(map[string]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	e, ok := payload["err"].(map[string]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	me := &MutationError{Field: field}
+
+	if code, ok := e["code"].(float64); ok {
+		me.Code = int(code)
+	}
+
+	if message, ok := e["message"].(string); ok {
+		me.Message = message
+	}
+
+	return me
+}
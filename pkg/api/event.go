@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Sender is the user who caused a chat event
+type Sender struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Displayname   string `json:"displayname"`
+	Avatar        string `json:"avatar"`
+	PartnerStatus string `json:"partnerStatus"`
+}
+
+// StreamMessage is a single chat event received from StreamMessageSubscription
+// Type is one of the MessageType constants, only the fields belonging to that type are set
+type StreamMessage struct {
+	Type           string      `json:"type"`           // The kind of chat event
+	ID             string      `json:"id"`             // Unique ID of the event
+	Content        string      `json:"content"`        // Text of a chat message
+	Gift           string      `json:"gift"`           // The gift that was donated
+	Amount         json.Number `json:"amount"`         // How many of the gift were donated
+	RecentCount    int         `json:"recentCount"`    // How many gifts the sender has donated in the current combo
+	ExpireDuration int         `json:"expireDuration"` // Seconds until the current gift combo expires
+	Viewer         int         `json:"viewer"`         // How many viewers a host brought with them
+	Month          json.Number `json:"month"`          // How many months the sender has subscribed for
+	Mode           string      `json:"mode"`           // The chat mode that was set
+	IDs            []string    `json:"ids"`            // IDs of deleted chat messages
+	Add            bool        `json:"add"`            // If the sender was made a moderator, false if removed
+	Emote          string      `json:"emote"`          // The emote that was added
+	Subscribing    bool        `json:"subscribing"`    // If the sender is subscribed to the streamer
+	Role           string      `json:"role"`           // The sender's role on DLive
+	RoomRole       string      `json:"roomRole"`       // The sender's role in the streamer's chat
+	Sender         Sender      `json:"sender"`         // The user who caused the event
+}
+
+// giftLemons is what each gift is worth in lemons, the cheapest gift
+var giftLemons = map[string]int64{
+	GiftLemon:      1,
+	GiftIceCream:   10,
+	GiftDiamond:    100,
+	GiftNinjaghini: 1000,
+	GiftNinjet:     10000,
+}
+
+// Lemons gives what a gift event is worth in lemons, 0 for other events or unknown gifts
+func (m StreamMessage) Lemons() int64 {
+	amount, err := m.Amount.Int64()
+
+	if m.Type != MessageTypeGift || err != nil {
+		return 0
+	}
+
+	return giftLemons[m.Gift] * amount
+}
+
+// Months gives how many months a subscription event is for, at least 1
+func (m StreamMessage) Months() int64 {
+	months, err := m.Month.Int64()
+
+	if err != nil || months < 1 {
+		return 1
+	}
+
+	return months
+}
+
+// MessageFilter reports if a chat event should be kept
+type MessageFilter func(m StreamMessage) bool
+
+// streamFrame is a decoded websocket data message holding chat events
+type streamFrame struct {
+	header   frameHeader       // The message the events came from
+	field    string            // The subscription field in the payload data holding the events
+	raw      []json.RawMessage // Each event as it was received
+	messages []StreamMessage   // Each event decoded
+}
+
+// DecodeStreamMessages gives the chat events held in a message read from a Subscription
+func DecodeStreamMessages(p []byte) ([]StreamMessage, error) {
+	f, err := decodeStreamFrame(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f.messages, nil
+}
+
+// decodeStreamFrame decodes a websocket message holding subscription results
+// The results may be a single event or a list of events
+func decodeStreamFrame(p []byte) (*streamFrame, error) {
+	var f streamFrame
+
+	if err := json.Unmarshal(p, &f.header); err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(f.header.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) != 1 {
+		return nil, errors.New("message does not hold a single subscription result")
+	}
+
+	for k, v := range payload.Data {
+		f.field = k
+
+		if err := json.Unmarshal(v, &f.raw); err != nil {
+			// Not a list, try a single event instead
+			f.raw = []json.RawMessage{v}
+		}
+	}
+
+	f.messages = make([]StreamMessage, len(f.raw))
+
+	for i, r := range f.raw {
+		if err := json.Unmarshal(r, &f.messages[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &f, nil
+}
+
+// filter encodes a websocket message holding only the events kept by the filter
+// Returns false if no events were kept
+func (f *streamFrame) filter(keep MessageFilter) ([]byte, bool) {
+	var raw []json.RawMessage
+
+	for i, m := range f.messages {
+		if keep(m) {
+			raw = append(raw, f.raw[i])
+		}
+	}
+
+	if len(raw) == 0 {
+		return nil, false
+	}
+
+	p, err := f.encode(raw)
+
+	return p, err == nil
+}
+
+// encode gives a websocket message like the one the frame was decoded from, holding the given events
+func (f *streamFrame) encode(raw []json.RawMessage) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":   f.header.ID,
+		"type": f.header.Type,
+		"payload": map[string]interface{}{
+			"data": map[string]interface{}{
+				f.field: raw,
+			},
+		},
+	})
+}
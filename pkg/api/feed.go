@@ -4,17 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 )
 
-const connectionInit = "connection_init"
-const connectionAckMessage = "connection_ack"
-const connectionKeepAliveMessage = "ka"
-
 // WebsocketFunc is the function used to setup the websocket used by a Feed
 type WebsocketFunc func(request WebSocketRequest) (*websocket.Conn, error)
 
@@ -24,198 +20,484 @@ type FeedMessage struct {
 	Payload     map[string]interface{} `json:"payload"` // The contents of the Response body
 }
 
-type Subscription struct {
-	feed     *Feed         // The feed this subscription belongs to
-	Key      string        // The unique ID for this subscription for its feed
-	Messages <-chan []byte // Channel that all new Response are written to
-}
-
-// Close removes this subscription from the feed
-func (s Subscription) Close() {
-	s.feed.Unsubscribe(s)
+// frameHeader is the part of a websocket message shared by every message type
+type frameHeader struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
 }
 
 // Feed is a real-time data stream using a websocket
 // When a feed receives data from its websocket, its writes that data to all its subscribers
 type Feed struct {
-	key           string                   // Unique identifier for this feed
-	quit          chan<- bool              // The channel used to terminate the goroutine writing to the stream channel
-	subscriptions map[string]chan<- []byte // A group of channels interested in this websocket connection's Feed
+	key           string                 // Unique identifier for this feed
+	mu            sync.Mutex             // Guards the fields below
+	protocol      protocol               // The subprotocol spoken over the websocket
+	conn          *websocket.Conn        // The websocket the feed is reading from
+	writeMu       sync.Mutex             // Serialises writes to the websocket
+	operationID   string                 // The ID of the GraphQL operation started on the websocket
+	quit          chan struct{}          // Closed to terminate the goroutine reading from the websocket
+	done          chan struct{}          // Closed once the goroutine reading from the websocket has returned
+	subscriptions map[string]*subscriber // A group of subscribers interested in this websocket connection's Feed
+	history       *history               // Recent chat events for late subscribers, nil if disabled
+	onClose       func()                 // Called once after the feed is first closed, without the lock held
+	log           Logger                 // Where the feed reports what it is doing, nil to stay silent
+	operation     string                 // Name of the GraphQL operation started on the websocket, for logging
+	routines      *routines              // Tracks the goroutines started for the feed
+}
+
+// newFeed creates an inactive feed with the given key that speaks the given protocol
+func newFeed(key string, p protocol) *Feed {
+	return &Feed{
+		key:           key,
+		protocol:      p,
+		subscriptions: make(map[string]*subscriber),
+		routines:      newRoutines(),
+	}
+}
+
+// logger gives the feed's Logger, with the feed's key and operation attached to every message
+func (f *Feed) logger() feedLogger {
+	if f.log == nil {
+		return feedLogger{Logger: nopLogger{}}
+	}
+
+	return feedLogger{Logger: f.log, key: f.key, operation: f.operation}
+}
+
+// feedLogger adds a feed's fields to every message logged
+type feedLogger struct {
+	Logger
+	key       string
+	operation string
+}
+
+func (l feedLogger) fields(args []interface{}) []interface{} {
+	fields := []interface{}{logKeyFeed, l.key}
+
+	if l.operation != "" {
+		fields = append(fields, logKeyOperation, l.operation)
+	}
+
+	return append(fields, args...)
 }
 
+func (l feedLogger) Debug(msg string, args ...interface{}) { l.Logger.Debug(msg, l.fields(args)...) }
+func (l feedLogger) Info(msg string, args ...interface{})  { l.Logger.Info(msg, l.fields(args)...) }
+func (l feedLogger) Warn(msg string, args ...interface{})  { l.Logger.Warn(msg, l.fields(args)...) }
+func (l feedLogger) Error(msg string, args ...interface{}) { l.Logger.Error(msg, l.fields(args)...) }
+
 func (f *Feed) String() string {
-	return fmt.Sprintf("feed(%s) -- subscription count(%d) -- active (%t)", f.key, len(f.subscriptions), f.Active())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fmt.Sprintf("feed(%s) -- subscription count(%d) -- active (%t)", f.key, len(f.subscriptions), f.active())
 }
 
 // Active indicates if the feed has an active websocket connection
 func (f *Feed) Active() bool {
-	return f.quit != nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.active()
 }
 
-// Publish will send the data given to all output channels it currently knows of
-// Returns the length of data, times the number of output channels data was written to
-// Returns an error if Feed has no output channels
+func (f *Feed) active() bool {
+	if f.quit == nil {
+		return false
+	}
+
+	select {
+	case <-f.quit:
+		return false
+	default:
+		return true
+	}
+}
+
+// SetHistory keeps the feed's recent chat events so new subscriptions can replay them using WithHistory
+// size limits how many events are kept and age limits how old they may be, either may be 0 for no limit
+// Setting both to 0 disables history and discards any events kept
+func (f *Feed) SetHistory(size int, age time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= 0 && age <= 0 {
+		f.history = nil
+		return
+	}
+
+	h := newHistory(size, age)
+
+	// Carry over what the feed already has, within the new limits
+	if f.history != nil {
+		h.entries = append(h.entries, f.history.recent(time.Now())...)
+
+		if size > 0 && len(h.entries) > size {
+			h.entries = h.entries[len(h.entries)-size:]
+		}
+	}
+
+	f.history = h
+}
+
+// stopped indicates if the feed has been started and since closed, a stopped feed can't be restarted
+func (f *Feed) stopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.quit != nil && !f.active()
+}
+
+// Done returns a channel that is closed once the feed's websocket consumer has stopped
+// Returns nil if the feed has never been started
+func (f *Feed) Done() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.done
+}
+
+// Publish will queue the data given for all subscribers it currently knows of
+// Publishing never blocks on a slow subscriber, each subscriber receives data in the order it was published
+// Subscribers with a filter only receive the chat events they are interested in, data holding no chat events is given to every subscriber
+// Returns the length of data queued, summed over all subscribers
+// Returns an error if Feed has no subscribers
 func (f *Feed) Publish(p []byte) (int, error) {
 	if len(p) == 0 {
-		log.Println("publish -- payload has 0 len")
 		return 0, nil
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Chat events are only decoded once, and only if a subscriber needs them filtered or the feed keeps history
+	var frame *streamFrame
+	decoded := false
+
+	if f.history != nil {
+		frame, _ = decodeStreamFrame(p)
+		decoded = true
+
+		if frame != nil {
+			f.history.add(frame, time.Now())
+		}
+	}
+
 	if len(f.subscriptions) == 0 {
 		return 0, errors.New("no output channels to write to")
 	}
 
-	for k, c := range f.subscriptions {
-		go func(data []byte, c chan<- []byte) {
-			select {
-			case c <- data:
-				log.Printf("(%s) -- writing data to subscriber channel (%s)...\n", f, k)
-				return
-			default:
-				log.Printf("(%s) -- waiting to write to subscriber channel (%s)...\n", f, k)
-				time.Sleep(time.Second)
+	n := 0
+
+	for key, s := range f.subscriptions {
+		data := p
+
+		if s.filter != nil {
+			if !decoded {
+				frame, _ = decodeStreamFrame(p)
+				decoded = true
 			}
-		}(p, c)
+
+			if frame != nil {
+				var ok bool
+
+				if data, ok = frame.filter(s.filter); !ok {
+					continue
+				}
+			}
+		}
+
+		if s.push(data) {
+			f.logger().Warn("subscription is behind, dropping its oldest messages", logKeySubscription, key, "limit", s.limit)
+		}
+
+		n += len(data)
 	}
 
-	return len(f.subscriptions) * len(p), nil
+	return n, nil
 }
 
-// Subscribe creates a new Subscription for the feed
-func (f *Feed) Subscribe() (*Subscription, error) {
-	var s Subscription
-
+// Subscribe creates a new Subscription for the feed, configured by the given options
+// Returns ErrFeedClosed if the feed has already been closed
+func (f *Feed) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
 	id, err := uuid.NewV4()
 
 	if err != nil {
-		return &s, err
+		return nil, err
+	}
+
+	s := newSubscriber(opts...)
+
+	f.mu.Lock()
+
+	if f.quit != nil && !f.active() {
+		f.mu.Unlock()
+		return nil, ErrFeedClosed
+	}
+
+	f.routines.deliver(s)
+
+	// Replaying while holding the lock means nothing can be published between the history and live data
+	if s.replay && f.history != nil {
+		f.replay(s)
 	}
 
-	c := make(chan []byte)
+	f.subscriptions[id.String()] = s
 
-	f.subscriptions[id.String()] = c
+	f.logger().Debug("subscription added", logKeySubscription, id.String(), "history", s.replay)
 
-	s = Subscription{
+	f.mu.Unlock()
+
+	return &Subscription{
 		feed:     f,
+		sub:      s,
 		Key:      id.String(),
-		Messages: c,
+		Messages: s.out,
+	}, nil
+}
+
+// replay queues the feed's history for the subscriber, the feed's lock must be held
+func (f *Feed) replay(s *subscriber) {
+	var backlog [][]byte
+
+	for _, e := range f.history.recent(time.Now()) {
+		if s.filter == nil || s.filter(e.message) {
+			backlog = append(backlog, e.data)
+		}
 	}
 
-	return &s, nil
+	if s.replayLimit > 0 && len(backlog) > s.replayLimit {
+		backlog = backlog[len(backlog)-s.replayLimit:]
+	}
+
+	for _, p := range backlog {
+		s.push(p)
+	}
 }
 
 // Unsubscribe closes the subscription's channel and removes it from its map of subscribers
+// The feed is closed once its last subscription is removed
 func (f *Feed) Unsubscribe(subscription Subscription) {
-	if c, ok := f.subscriptions[subscription.Key]; ok {
-		close(c)
-		delete(f.subscriptions, subscription.Key)
+	f.mu.Lock()
 
-		if len(f.subscriptions) == 0 {
-			f.Close()
-		}
+	s, ok := f.subscriptions[subscription.Key]
+
+	if !ok {
+		f.mu.Unlock()
+		return
+	}
+
+	s.stop(ErrUnsubscribed)
+	delete(f.subscriptions, subscription.Key)
+
+	f.logger().Debug("subscription removed", logKeySubscription, subscription.Key)
+
+	last := len(f.subscriptions) == 0
+
+	f.mu.Unlock()
+
+	if last {
+		f.Close()
 	}
 }
 
-// Close sends a termination signal to consumer go routine, closes the termination signal channel, and closes all subscriptions
+// Close terminates the websocket consumer and closes all subscriptions, which end with ErrFeedClosed
+// Close is safe to call more than once, and does not block on subscribers that are no longer reading
 func (f *Feed) Close() {
-	// Send termination signal to goroutine
-	f.quit <- true
+	f.shutdown(ErrFeedClosed)
+}
 
-	// Close termination channel
-	close(f.quit)
+// shutdown closes the feed, ending its subscriptions with the given reason
+func (f *Feed) shutdown(reason error) {
+	f.mu.Lock()
 
-	// Unset websocket channels
-	f.quit = nil
+	f.close(reason)
+
+	f.finish()
+}
+
+// abort closes the feed like shutdown, but subscriptions end straight away without waiting for their data to be read
+func (f *Feed) abort(reason error) {
+	f.mu.Lock()
+
+	for _, s := range f.subscriptions {
+		s.stop(reason)
+	}
+
+	f.close(reason)
+
+	f.finish()
+}
+
+// finish releases the feed's lock, then runs the close callback if it hasn't been already
+func (f *Feed) finish() {
+	onClose := f.onClose
+	f.onClose = nil
+
+	f.mu.Unlock()
+
+	if onClose != nil {
+		onClose()
+	}
+}
+
+// close does the work of shutdown, the feed's lock must be held
+func (f *Feed) close(reason error) {
+	if f.quit == nil {
+		// Never started, make sure it never will be
+		f.quit = make(chan struct{})
+		close(f.quit)
+	} else if f.active() {
+		close(f.quit)
+		f.logger().Info("feed closed", "reason", reason)
+	}
+
+	// Tell the server we are done, then close the socket to unblock the consumer goroutine's pending read
+	if f.conn != nil {
+		f.stop()
+		f.conn.Close()
+		f.conn = nil
+	}
 
-	// Close any existing output channels
-	for k, v := range f.subscriptions {
-		close(v)
+	// Any data already queued is still handed to subscribers before their channels close
+	for k, s := range f.subscriptions {
+		s.end(reason)
 		delete(f.subscriptions, k)
 	}
 }
 
+// stop tells the server the feed is done with the operation and the connection
+func (f *Feed) stop() {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	f.protocol.close(f.conn, f.operationID)
+}
+
+// ended records that the server has finished the operation, so it isn't stopped when the feed closes
+func (f *Feed) ended() {
+	f.mu.Lock()
+	f.operationID = ""
+	f.mu.Unlock()
+}
+
+// pong replies to a ping from the server
+func (f *Feed) pong(conn *websocket.Conn) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(stopTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	return conn.WriteJSON(WebSocketRequest{Type: pongMessage})
+}
+
 // Start uses the provided Request and websocketFunc to start a GraphQL websocket connection
 // Returns an error if the feed already been started
 func (f *Feed) Start(socketRequest WebSocketRequest, websocketFunc WebsocketFunc) error {
+	f.mu.Lock()
+
 	if f.quit != nil {
+		f.mu.Unlock()
+
+		if f.stopped() {
+			return ErrFeedClosed
+		}
+
 		return errors.New("feed has already been started")
 	}
 
+	// Claim the feed before dialing so concurrent starts fail fast
+	f.quit = make(chan struct{})
+	f.done = make(chan struct{})
+
+	f.mu.Unlock()
+
 	// Setup websocket using provided func
 	conn, err := websocketFunc(socketRequest)
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	if err != nil {
+		f.close(&ConnectionError{Err: err})
+		close(f.done)
 		return err
 	}
 
-	q, s := f.Consume(conn)
-	sq := make(chan bool)
+	select {
+	case <-f.quit:
+		// Feed was closed while the websocket was being set up
+		conn.Close()
+		close(f.done)
+		return errors.New("feed was closed before it could start")
+	default:
+	}
 
-	f.quit = sq
+	f.conn = conn
+	f.operationID = socketRequest.ID
 
-	go func(feed *Feed, quitFeed <-chan bool, quitConsume chan<- bool, streamConsume <-chan []byte) {
-		defer close(quitConsume)
+	f.operation = socketRequest.operation()
 
-		for {
-			select {
-			case <-quitFeed:
-				log.Printf("(%s) -- termination signal received, terminating consumer...\n", f)
-				quitConsume <- true
-				return
-			case m, ok := <-streamConsume:
-				if !ok {
-					log.Printf("%s -- upstream channel has closed, closing feed...\n", feed)
-					feed.Close()
-					return
-				}
-				if _, err := feed.Publish(m); err != nil {
-					log.Printf("(%s) -- error when publishing stream to subscribers: %s\n", feed, err)
-				}
-			default:
-				log.Printf("(%s) -- waiting on message from socket...\n", feed)
-				time.Sleep(time.Second)
-			}
-		}
-	}(f, sq, q, s)
+	f.logger().Info("feed started", "subscriptions", len(f.subscriptions))
+
+	f.routines.consume(f, conn)
 
 	return nil
 }
 
-// Consume uses the provided websocket to continuously read data from the socket and write it to the downstream channel
-// Go routine will return when a termination signal is sent via the quit channel
-func (f *Feed) Consume(conn *websocket.Conn) (chan<- bool, <-chan []byte) {
-	q := make(chan bool)
-	s := make(chan []byte)
+// consume continuously reads messages from the websocket and publishes data to the feed's subscribers
+// Returns once the socket fails, the server ends the operation, or the feed is closed
+// The feed is closed on the way out, ending subscriptions with the reason the consumer stopped
+func (f *Feed) consume(conn *websocket.Conn) {
+	defer close(f.done)
+
+	reason := ErrFeedClosed
 
-	go func(socket *websocket.Conn, quit <-chan bool, stream chan<- []byte, feed *Feed) {
-		defer conn.Close()
-		defer close(stream)
+	defer func() {
+		f.shutdown(reason)
+	}()
 
-		for {
-			_, m, err := conn.ReadMessage()
+	for {
+		_, m, err := conn.ReadMessage()
 
-			if err != nil {
-				log.Printf("(%s) -- error reading websocket: %s\n", feed, err)
-				return
+		if err != nil {
+			select {
+			case <-f.quit:
+			default:
+				f.logger().Warn("error reading websocket", logKeyError, err)
+				reason = &ConnectionError{Err: err}
 			}
+			return
+		}
 
-			var message FeedMessage
+		var message frameHeader
 
-			err = json.Unmarshal(m, &message)
+		if err := json.Unmarshal(m, &message); err != nil {
+			f.logger().Warn("unable to decode websocket message", logKeyError, err)
+			continue
+		}
 
-			if message.MessageType == connectionAckMessage || message.MessageType == connectionKeepAliveMessage {
-				continue
+		switch f.protocol.kind(message.Type) {
+		case frameData:
+			if _, err := f.Publish(m); err != nil {
+				f.logger().Debug("unable to publish message", logKeyError, err)
 			}
-
-			select {
-			case <-quit:
-				log.Printf("(%s) -- termination signal received, closing websocket and channel...\n", feed)
-				return
-			case stream <- m:
-				log.Printf("(%s) -- writing stream to feed...\n", feed)
+		case frameError:
+			// The server has given up on the operation, subscribers are given its error once their data is drained
+			reason = newGraphQLError(message.Payload)
+			f.logger().Error("server ended operation with an error", logKeyError, reason)
+			f.ended()
+			return
+		case frameComplete:
+			reason = ErrFeedCompleted
+			f.ended()
+			return
+		case framePing:
+			if err := f.pong(conn); err != nil {
+				f.logger().Warn("error replying to ping", logKeyError, err)
 			}
 		}
-	}(conn, q, s, f)
-
-	return q, s
+	}
 }
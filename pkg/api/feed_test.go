@@ -1,15 +1,81 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-func TestFeed_String(t *testing.T) {
-	f := Feed{
-		key: "test",
-		subscriptions: make(map[string]chan<- []byte),
+// testSocket is a websocket server for tests, each connection is handed to the handler
+// The default handler writes whatever frames the test gives it
+type testSocket struct {
+	server *httptest.Server
+	frames chan []byte
+}
+
+func newTestSocket(t testing.TB) *testSocket {
+	ts := &testSocket{
+		frames: make(chan []byte),
 	}
 
+	ts.serve(t, func(conn *websocket.Conn) {
+		for m := range ts.frames {
+			if err := conn.WriteMessage(websocket.TextMessage, m); err != nil {
+				return
+			}
+		}
+	})
+
+	return ts
+}
+
+func (ts *testSocket) serve(t testing.TB, handler func(conn *websocket.Conn)) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{ProtocolGraphQLWS, ProtocolGraphQLTransportWS},
+	}
+
+	ts.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			t.Error("unable to upgrade test websocket: ", err)
+			return
+		}
+
+		defer conn.Close()
+
+		handler(conn)
+	}))
+}
+
+// url gives the websocket url for the test server
+func (ts *testSocket) url() string {
+	return "ws" + strings.TrimPrefix(ts.server.URL, "http")
+}
+
+// dial is a WebsocketFunc connecting to the test server
+func (ts *testSocket) dial(req WebSocketRequest) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url(), nil)
+
+	return conn, err
+}
+
+func (ts *testSocket) Close() {
+	if ts.frames != nil {
+		close(ts.frames)
+	}
+	ts.server.Close()
+}
+
+func TestFeed_String(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+
 	expected := "feed(test) -- subscription count(0) -- active (false)"
 
 	result := f.String()
@@ -21,7 +87,7 @@ func TestFeed_String(t *testing.T) {
 
 func TestFeed_Active(t *testing.T) {
 	f := Feed{
-		quit: make(chan<- bool),
+		quit: make(chan struct{}),
 	}
 
 	active := f.Active()
@@ -32,17 +98,13 @@ func TestFeed_Active(t *testing.T) {
 }
 
 func TestFeed_Publish(t *testing.T) {
-	chan1 := make(chan []byte)
-	chan2 := make(chan []byte)
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
 
-	f := Feed{
-		subscriptions: map[string]chan<- []byte{
-			"one": chan1,
-			"two": chan2,
-		},
-	}
+	one, _ := f.Subscribe()
+	two, _ := f.Subscribe()
 
-	p := []byte{'h','e','l','l','o'}
+	p := []byte{'h', 'e', 'l', 'l', 'o'}
 
 	res, err := f.Publish(p)
 
@@ -55,12 +117,207 @@ func TestFeed_Publish(t *testing.T) {
 	if res != expected {
 		t.Errorf("expected return length of %d, got %d", expected, res)
 	}
+
+	for _, s := range []*Subscription{one, two} {
+		select {
+		case m := <-s.Messages:
+			if string(m) != string(p) {
+				t.Errorf("subscriber received --%s--, should have been --%s--", m, p)
+			}
+		case <-time.After(time.Second):
+			t.Error("subscriber never received published data")
+		}
+	}
 }
 
-func TestFeed_Subscribe(t *testing.T) {
-	f := Feed{
-		subscriptions: make(map[string]chan<- []byte),
+func TestFeed_PublishOrder(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	s, _ := f.Subscribe()
+
+	// Nobody is reading yet, publishing must not block
+	for _, m := range []string{"1", "2", "3"} {
+		f.Publish([]byte(m))
+	}
+
+	for _, expected := range []string{"1", "2", "3"} {
+		if m := <-s.Messages; string(m) != expected {
+			t.Errorf("received %s, expected %s", m, expected)
+		}
+	}
+}
+
+func TestFeed_PublishQueueLimit(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	s, _ := f.Subscribe(WithQueueLimit(2))
+
+	for _, m := range []string{"1", "2", "3", "4", "5"} {
+		f.Publish([]byte(m))
+	}
+
+	var received []string
+
+	for {
+		select {
+		case m := <-s.Messages:
+			received = append(received, string(m))
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		break
+	}
+
+	// One message may already be on its way to the consumer when the queue fills
+	if n := len(received); n < 2 || n > 3 || received[n-2] != "4" || received[n-1] != "5" {
+		t.Errorf("expected the oldest messages dropped, received %v", received)
+	}
+
+	if s.Dropped()+len(received) != 5 {
+		t.Errorf("expected %d dropped, got %d", 5-len(received), s.Dropped())
+	}
+}
+
+func TestFeed_SubscribeFilter(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	all, _ := f.Subscribe()
+	gifts, _ := f.Subscribe(WithMessageTypes(MessageTypeGift))
+	moderators, _ := f.Subscribe(WithFilter(func(m StreamMessage) bool {
+		return m.RoomRole == RoomRoleModerator
+	}))
+
+	f.Publish([]byte(`{"id":"1","type":"data","payload":{"data":{"streamMessageReceived":[
+		{"type":"Message","id":"a","content":"hi","roomRole":"Moderator"},
+		{"type":"Gift","id":"b","gift":"LEMON","amount":"5","roomRole":"Member"},
+		{"type":"Message","id":"c","content":"hello","roomRole":"Member"}
+	]}}}`))
+
+	// Frames without chat events are not filtered
+	f.Publish([]byte(`{"id":"1","type":"error","payload":{"message":"bad"}}`))
+
+	expected := map[*Subscription][]string{
+		all:        {"a", "b", "c"},
+		gifts:      {"b"},
+		moderators: {"a"},
+	}
+
+	for s, ids := range expected {
+		messages, err := DecodeStreamMessages(<-s.Messages)
+
+		if err != nil {
+			t.Fatal("unable to decode filtered messages: ", err)
+		}
+
+		if len(messages) != len(ids) {
+			t.Fatalf("subscriber should have received %d events, got %d", len(ids), len(messages))
+		}
+
+		for i, m := range messages {
+			if m.ID != ids[i] {
+				t.Errorf("expected event %s, got %s", ids[i], m.ID)
+			}
+		}
+
+		if m := <-s.Messages; !strings.Contains(string(m), "bad") {
+			t.Errorf("error message should reach every subscriber, received --%s--", m)
+		}
+	}
+
+	if messages, _ := DecodeStreamMessages([]byte(`{"type":"data","payload":{"data":{"streamMessageReceived":[{"type":"Gift","amount":"5"}]}}}`)); messages[0].Amount.String() != "5" {
+		t.Errorf("gift amount should decode as 5, got %s", messages[0].Amount)
+	}
+}
+
+// chatFrame gives a data message holding a chat message event for each of the ids
+func chatFrame(ids ...string) []byte {
+	var events []string
+
+	for _, id := range ids {
+		events = append(events, `{"type":"Message","id":"`+id+`"}`)
+	}
+
+	return []byte(`{"id":"1","type":"data","payload":{"data":{"streamMessageReceived":[` + strings.Join(events, ",") + `]}}}`)
+}
+
+// receiveIDs reads count events from the subscription and gives their ids
+func receiveIDs(t *testing.T, s *Subscription, count int) []string {
+	var ids []string
+
+	for len(ids) < count {
+		select {
+		case m := <-s.Messages:
+			messages, err := DecodeStreamMessages(m)
+
+			if err != nil {
+				t.Fatal("unable to decode messages: ", err)
+			}
+
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only received %d of %d events", len(ids), count)
+		}
+	}
+
+	return ids
+}
+
+func TestFeed_SubscribeWithHistory(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	f.SetHistory(3, 0)
+
+	// History is kept even while nobody is subscribed
+	f.Publish(chatFrame("a"))
+	f.Publish(chatFrame("b", "c"))
+	f.Publish(chatFrame("d"))
+
+	s, _ := f.Subscribe(WithHistory(0))
+	limited, _ := f.Subscribe(WithHistory(1))
+	live, _ := f.Subscribe()
+
+	f.Publish(chatFrame("e"))
+
+	expected := map[*Subscription]string{
+		s:       "b c d e",
+		limited: "d e",
+		live:    "e",
+	}
+
+	for sub, ids := range expected {
+		if received := strings.Join(receiveIDs(t, sub, len(strings.Fields(ids))), " "); received != ids {
+			t.Errorf("expected events %s, received %s", ids, received)
+		}
+	}
+}
+
+func TestHistory_Age(t *testing.T) {
+	h := newHistory(0, time.Second)
+	now := time.Now()
+
+	old, _ := decodeStreamFrame(chatFrame("a"))
+	recent, _ := decodeStreamFrame(chatFrame("b"))
+
+	h.add(old, now)
+	h.add(recent, now.Add(2*time.Second))
+
+	entries := h.recent(now.Add(2500 * time.Millisecond))
+
+	if len(entries) != 1 || entries[0].message.ID != "b" {
+		t.Errorf("only the recent event should be kept, got %d events", len(entries))
 	}
+}
+
+func TestFeed_Subscribe(t *testing.T) {
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
 
 	s, err := f.Subscribe()
 
@@ -68,61 +325,205 @@ func TestFeed_Subscribe(t *testing.T) {
 		t.Error("error when subscribing to feed: ", err)
 	}
 
-	if s.feed != &f {
+	if s.feed != f {
 		t.Error("subscription has incorrect feed reference")
 	}
 }
 
 func TestFeed_Unsubscribe(t *testing.T) {
-	c := make(chan []byte)
-	q := make(chan bool)
-
-	s := Subscription{
-		Key: "1",
-		Messages: c,
-	}
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
 
-	f := Feed{
-		quit: q,
-		subscriptions: map[string]chan<- []byte{
-			s.Key: c,
-			"2": make(chan<- []byte),
-		},
-	}
+	s, _ := f.Subscribe()
+	f.Subscribe()
 
-	f.Unsubscribe(s)
+	f.Unsubscribe(*s)
 
 	subCount := len(f.subscriptions)
 
 	if subCount != 1 {
-		t.Errorf("feed should have 0 active subscriptions, still has %d", subCount)
+		t.Errorf("feed should have 1 active subscription, has %d", subCount)
+	}
+
+	if _, ok := <-s.Messages; ok {
+		t.Error("subscription channel should be closed after unsubscribing")
 	}
 }
 
 func TestFeed_Close(t *testing.T) {
-	q := make(chan bool)
+	f := newFeed("test", graphqlWS)
+	f.quit = make(chan struct{})
 
-	f := Feed{
-		quit: q,
-		subscriptions: map[string]chan<- []byte{
-			"1": make(chan<- []byte),
-			"2": make(chan<- []byte),
-		},
+	one, _ := f.Subscribe()
+	two, _ := f.Subscribe()
+
+	f.Close()
+
+	// A second close must not block or panic
+	f.Close()
+
+	if len(f.subscriptions) > 0 {
+		t.Error("feed should not have any subscriptions left over after close")
 	}
 
-	go f.Close()
+	if f.Active() {
+		t.Error("feed should not be active after close")
+	}
 
-	sig := <- q
+	for _, s := range []*Subscription{one, two} {
+		if _, ok := <-s.Messages; ok {
+			t.Error("subscription channel should be closed after feed close")
+		}
+	}
+}
+
+func TestFeed_Start(t *testing.T) {
+	ts := newTestSocket(t)
+	defer ts.Close()
+
+	f := newFeed("test", graphqlWS)
 
-	if !sig {
-		t.Error("feed should send true bool value to quit channel during close")
+	s, _ := f.Subscribe()
+
+	if err := f.Start(WebSocketRequest{}, ts.dial); err != nil {
+		t.Fatal("unable to start feed: ", err)
 	}
 
-	if len(f.subscriptions) > 0 {
-		t.Error("feed should not have any subscriptions left over after close")
+	if err := f.Start(WebSocketRequest{}, ts.dial); err == nil {
+		t.Error("starting a feed twice should return an error")
+	}
+
+	ts.frames <- []byte(`{"type":"ka"}`)
+	ts.frames <- []byte(`{"type":"data","payload":{}}`)
+
+	select {
+	case m := <-s.Messages:
+		if !strings.Contains(string(m), `"data"`) {
+			t.Errorf("keep alive should have been skipped, received --%s--", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data frame never reached subscriber")
+	}
+
+	f.Close()
+
+	select {
+	case <-f.Done():
+	case <-time.After(time.Second):
+		t.Error("feed consumer did not stop after close")
+	}
+}
+
+func TestFeed_StartError(t *testing.T) {
+	ts := newTestSocket(t)
+	defer ts.Close()
+
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	s, _ := f.Subscribe()
+
+	if err := f.Start(WebSocketRequest{}, ts.dial); err != nil {
+		t.Fatal("unable to start feed: ", err)
 	}
 
-	if f.quit != nil {
-		t.Error("feed's quit channel should be unset during close")
+	ts.frames <- chatFrame("a")
+	ts.frames <- []byte(`{"type":"error","payload":[{"message":"bad"}]}`)
+
+	// Data sent before the error is still delivered
+	receiveIDs(t, s, 1)
+
+	if _, ok := <-s.Messages; ok {
+		t.Error("subscription should close after the server sends an error")
 	}
-}
\ No newline at end of file
+
+	<-s.Done()
+
+	var gqlErr *GraphQLError
+
+	if !errors.As(s.Err(), &gqlErr) || gqlErr.Messages[0] != "bad" {
+		t.Errorf("subscription should end with the server's error, got %v", s.Err())
+	}
+}
+
+func TestSubscription_Err(t *testing.T) {
+	ts := newTestSocket(t)
+
+	f := newFeed("test", graphqlWS)
+	defer f.Close()
+
+	closed, _ := f.Subscribe()
+	s, _ := f.Subscribe()
+
+	if err := f.Start(WebSocketRequest{}, ts.dial); err != nil {
+		t.Fatal("unable to start feed: ", err)
+	}
+
+	if s.Err() != nil {
+		t.Errorf("subscription should have no error while active, got %v", s.Err())
+	}
+
+	closed.Close()
+
+	if _, err := closed.Next(context.Background()); err != ErrUnsubscribed {
+		t.Errorf("closed subscription should end with %v, got %v", ErrUnsubscribed, err)
+	}
+
+	// Losing the socket ends the feed with a connection error
+	ts.Close()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription never ended after losing the socket")
+	}
+
+	var connErr *ConnectionError
+
+	if !errors.As(s.Err(), &connErr) {
+		t.Errorf("subscription should end with a connection error, got %v", s.Err())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	idle := newFeed("test", graphqlWS)
+	defer idle.Close()
+
+	live, _ := idle.Subscribe()
+
+	if _, err := live.Next(ctx); err != context.Canceled {
+		t.Errorf("next should give the context's error, got %v", err)
+	}
+}
+
+// BenchmarkFeed_Latency measures the time from a frame being written to the websocket until it is read from a subscription
+func BenchmarkFeed_Latency(b *testing.B) {
+	ts := newTestSocket(b)
+	defer ts.Close()
+
+	f := newFeed("bench", graphqlWS)
+
+	s, _ := f.Subscribe()
+
+	if err := f.Start(WebSocketRequest{}, ts.dial); err != nil {
+		b.Fatal("unable to start feed: ", err)
+	}
+
+	defer f.Close()
+
+	frame := []byte(`{"type":"data","payload":{"data":{"streamMessageReceived":[{"type":"Message","content":"hello"}]}}}`)
+
+	var total time.Duration
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		ts.frames <- frame
+		<-s.Messages
+		total += time.Since(start)
+	}
+
+	b.ReportMetric(float64(total.Microseconds())/float64(b.N), "µs/frame")
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"time"
+)
+
+// historyEntry is a single chat event kept by a feed's history
+type historyEntry struct {
+	at      time.Time     // When the event was published
+	message StreamMessage // The decoded event, used to apply subscriber filters
+	data    []byte        // A websocket message holding only this event
+}
+
+// history is a ring buffer of a feed's recent chat events, bounded by count, age, or both
+type history struct {
+	size    int            // Maximum number of events kept, 0 for no limit
+	age     time.Duration  // Maximum age of events kept, 0 for no limit
+	entries []historyEntry // Events in the order they were published, starting at head
+	head    int            // Index of the oldest event once the buffer has wrapped
+}
+
+func newHistory(size int, age time.Duration) *history {
+	return &history{
+		size: size,
+		age:  age,
+	}
+}
+
+// add records each event in the published frame, evicting the oldest events once full
+func (h *history) add(frame *streamFrame, at time.Time) {
+	for i, m := range frame.messages {
+		data, err := frame.encode(frame.raw[i : i+1])
+
+		if err != nil {
+			continue
+		}
+
+		e := historyEntry{
+			at:      at,
+			message: m,
+			data:    data,
+		}
+
+		if h.size > 0 && len(h.entries) == h.size {
+			h.entries[h.head] = e
+			h.head = (h.head + 1) % h.size
+			continue
+		}
+
+		h.entries = append(h.entries, e)
+	}
+
+	h.expire(at)
+}
+
+// expire drops events older than the history's age limit
+func (h *history) expire(now time.Time) {
+	if h.age <= 0 {
+		return
+	}
+
+	recent := h.recent(now)
+
+	// Compact the ring so the oldest event is back at the start
+	h.entries = append(h.entries[:0], recent...)
+	h.head = 0
+}
+
+// recent gives the events kept, oldest first, that are within the age limit
+func (h *history) recent(now time.Time) []historyEntry {
+	ordered := make([]historyEntry, 0, len(h.entries))
+	ordered = append(ordered, h.entries[h.head:]...)
+	ordered = append(ordered, h.entries[:h.head]...)
+
+	if h.age <= 0 {
+		return ordered
+	}
+
+	for i, e := range ordered {
+		if now.Sub(e.at) <= h.age {
+			return ordered[i:]
+		}
+	}
+
+	return nil
+}
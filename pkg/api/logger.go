@@ -0,0 +1,51 @@
+package api
+
+import (
+	"strings"
+)
+
+// Logger receives messages about what a Client and its feeds are doing
+// Arguments after the message are alternating keys and values, so a *slog.Logger can be used directly
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger discards everything, it is used when no Logger is given
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// Keys used for structured log fields
+const logKeyFeed = "feed"
+const logKeySubscription = "subscription"
+const logKeyOperation = "operation"
+const logKeyError = "error"
+
+// operationName gives the name of the operation defined by a GraphQL document, or an empty string if it is anonymous
+func operationName(query string) string {
+	fields := strings.Fields(query)
+
+	if len(fields) < 2 {
+		return ""
+	}
+
+	switch fields[0] {
+	case "query", "mutation", "subscription":
+	default:
+		return ""
+	}
+
+	name := fields[1]
+
+	if i := strings.IndexAny(name, "({"); i >= 0 {
+		name = name[:i]
+	}
+
+	return name
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket subprotocols a Client can use for feeds
+const ProtocolGraphQLWS = "graphql-ws"
+const ProtocolGraphQLTransportWS = "graphql-transport-ws"
+
+// graphql-ws messages sent by the client
+const connectionInit = "connection_init"
+const connectionTerminate = "connection_terminate"
+const startMessage = "start"
+const stopMessage = "stop"
+
+// graphql-ws messages sent by the server
+const connectionAckMessage = "connection_ack"
+const connectionErrorMessage = "connection_error"
+const connectionKeepAliveMessage = "ka"
+const dataMessage = "data"
+const errorMessage = "error"
+const completeMessage = "complete"
+
+// graphql-transport-ws messages, connection init, connection ack, error and complete are shared with graphql-ws
+const subscribeMessage = "subscribe"
+const nextMessage = "next"
+const pingMessage = "ping"
+const pongMessage = "pong"
+
+// connectionAckTimeout is how long to wait for the server to acknowledge connection init
+const connectionAckTimeout = 10 * time.Second
+
+// stopTimeout is how long to wait on the socket when sending stop and terminate messages
+const stopTimeout = time.Second
+
+// frameKind is what a feed should do with a message received from the server
+type frameKind int
+
+const (
+	frameIgnore   frameKind = iota // Nothing to do, such as keep alives
+	frameData                      // Operation result to publish to subscribers
+	frameError                     // The operation or connection failed
+	frameComplete                  // The server has finished the operation
+	framePing                      // The server expects a pong in reply
+)
+
+// protocol describes the messages used by a GraphQL over websocket subprotocol
+type protocol struct {
+	name      string               // Value sent in the Sec-WebSocket-Protocol header
+	start     string               // Message type that starts an operation
+	stop      string               // Message type that stops an operation
+	terminate string               // Message type that ends the connection, empty if closing the socket is enough
+	frames    map[string]frameKind // How each message type from the server is handled
+}
+
+var graphqlWS = protocol{
+	name:      ProtocolGraphQLWS,
+	start:     startMessage,
+	stop:      stopMessage,
+	terminate: connectionTerminate,
+	frames: map[string]frameKind{
+		connectionAckMessage:       frameIgnore,
+		connectionKeepAliveMessage: frameIgnore,
+		dataMessage:                frameData,
+		errorMessage:               frameError,
+		connectionErrorMessage:     frameError,
+		completeMessage:            frameComplete,
+	},
+}
+
+var graphqlTransportWS = protocol{
+	name:  ProtocolGraphQLTransportWS,
+	start: subscribeMessage,
+	stop:  completeMessage,
+	frames: map[string]frameKind{
+		connectionAckMessage: frameIgnore,
+		pongMessage:          frameIgnore,
+		pingMessage:          framePing,
+		nextMessage:          frameData,
+		errorMessage:         frameError,
+		completeMessage:      frameComplete,
+	},
+}
+
+// lookupProtocol finds the protocol with the given name, an empty name gives graphql-ws
+func lookupProtocol(name string) (protocol, error) {
+	switch name {
+	case "", ProtocolGraphQLWS:
+		return graphqlWS, nil
+	case ProtocolGraphQLTransportWS:
+		return graphqlTransportWS, nil
+	default:
+		return protocol{}, fmt.Errorf("unsupported websocket protocol (%s)", name)
+	}
+}
+
+// kind gives how a message type from the server is handled, unknown types are ignored
+func (p protocol) kind(messageType string) frameKind {
+	if k, ok := p.frames[messageType]; ok {
+		return k
+	}
+
+	return frameIgnore
+}
+
+// init sends connection init with the given auth token and waits for the server to acknowledge it
+func (p protocol) init(conn *websocket.Conn, auth string) error {
+	init := connectionInitRequest{
+		Type: connectionInit,
+	}
+
+	if auth != "" {
+		init.Payload = map[string]string{
+			"authorization": auth,
+		}
+	}
+
+	if err := conn.WriteJSON(init); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(connectionAckTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		var message frameHeader
+
+		if err := conn.ReadJSON(&message); err != nil {
+			return err
+		}
+
+		if message.Type == connectionAckMessage {
+			return nil
+		}
+
+		switch p.kind(message.Type) {
+		case frameIgnore:
+			continue
+		case framePing:
+			if err := conn.WriteJSON(WebSocketRequest{Type: pongMessage}); err != nil {
+				return err
+			}
+		case frameError:
+			return fmt.Errorf("connection rejected by server: %s", message.Payload)
+		default:
+			return fmt.Errorf("unexpected message (%s) while waiting for connection ack", message.Type)
+		}
+	}
+}
+
+// startRequest gives the message that starts the given operation
+func (p protocol) startRequest(req WebSocketRequest) WebSocketRequest {
+	req.Type = p.start
+	return req
+}
+
+// close stops the operation with the given id, if there is one, and ends the connection
+// Errors are ignored as the socket is closed right after
+func (p protocol) close(conn *websocket.Conn, id string) {
+	conn.SetWriteDeadline(time.Now().Add(stopTimeout))
+
+	// There is nothing to stop once the server has ended the operation
+	if id != "" {
+		conn.WriteJSON(WebSocketRequest{
+			ID:   id,
+			Type: p.stop,
+		})
+	}
+
+	if p.terminate != "" {
+		conn.WriteJSON(WebSocketRequest{
+			Type: p.terminate,
+		})
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -506,6 +506,7 @@ func LivestreamPageQuery() string {
 		}
 		title
 		watchingCount
+		createdAt
 		totalReward
 		...VDonationGiftFrag
 		...VPostInfoShareFrag
@@ -1,10 +1,17 @@
 package api
 
+import "encoding/json"
+
 type Request struct {
 	Query string      `json:"query"`
 	Vars  interface{} `json:"variables"`
 }
 
+// OperationName gives the name of the operation the request's query defines, or an empty string if it is anonymous
+func (r Request) OperationName() string {
+	return operationName(r.Query)
+}
+
 type responseError struct {
 	Message string
 }
@@ -18,8 +25,39 @@ type Response struct {
 	Errors []responseError        `json:"errors"`
 }
 
+// WebSocketRequest is a message sent from the client over a GraphQL websocket
+// Payload is the Request when starting an operation, and left empty otherwise
 type WebSocketRequest struct {
 	ID      string  `json:"id"`
 	Type    string  `json:"type"`
 	Payload Request `json:"payload"`
 }
+
+// MarshalJSON leaves out an empty ID and payload, so messages such as stop and pong carry only what they need
+func (r WebSocketRequest) MarshalJSON() ([]byte, error) {
+	m := struct {
+		ID      string   `json:"id,omitempty"`
+		Type    string   `json:"type"`
+		Payload *Request `json:"payload,omitempty"`
+	}{
+		ID:   r.ID,
+		Type: r.Type,
+	}
+
+	if r.Payload.Query != "" {
+		m.Payload = &r.Payload
+	}
+
+	return json.Marshal(m)
+}
+
+// operation gives the name of the GraphQL operation the message starts, if any
+func (r WebSocketRequest) operation() string {
+	return operationName(r.Payload.Query)
+}
+
+// connectionInitRequest is the connection init message, its payload holds the connection parameters
+type connectionInitRequest struct {
+	Type    string            `json:"type"`
+	Payload map[string]string `json:"payload,omitempty"`
+}
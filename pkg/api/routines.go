@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// routines tracks the goroutines started for feeds, so they can all be stopped and waited on
+// A Client shares one between all its feeds
+type routines struct {
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	subscribers map[*subscriber]struct{} // Subscribers whose delivery goroutine is still running
+}
+
+func newRoutines() *routines {
+	return &routines{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// consume starts the feed's websocket consumer
+func (r *routines) consume(f *Feed, conn *websocket.Conn) {
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+		f.consume(conn)
+	}()
+}
+
+// deliver starts the subscriber's delivery goroutine
+func (r *routines) deliver(s *subscriber) {
+	r.mu.Lock()
+	r.subscribers[s] = struct{}{}
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		s.deliver()
+
+		r.mu.Lock()
+		delete(r.subscribers, s)
+		r.mu.Unlock()
+	}()
+}
+
+// stop ends every subscriber still delivering with the given reason, discarding data they have not read
+func (r *routines) stop(reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for s := range r.subscribers {
+		s.stop(reason)
+	}
+}
+
+// wait blocks until every tracked goroutine has returned, or the context is done
+func (r *routines) wait(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultQueueLimit is how many messages a subscription holds for a slow consumer before dropping the oldest
+const DefaultQueueLimit = 1000
+
+// Subscription is a consumer's view of a Feed
+// Messages is closed once the subscription ends, Err then reports why
+type Subscription struct {
+	feed     *Feed         // The feed this subscription belongs to
+	sub      *subscriber   // The feed's side of this subscription
+	Key      string        // The unique ID for this subscription for its feed
+	Messages <-chan []byte // Channel that all new Response are written to
+}
+
+// Close removes this subscription from the feed
+func (s Subscription) Close() {
+	s.feed.Unsubscribe(s)
+}
+
+// Done returns a channel that is closed once the subscription has ended and every message has been read from Messages
+func (s Subscription) Done() <-chan struct{} {
+	return s.sub.finished
+}
+
+// Err reports why the subscription ended, nil until Done is closed
+// The error is ErrUnsubscribed, ErrFeedClosed, ErrFeedCompleted, a *GraphQLError, or a *ConnectionError
+func (s Subscription) Err() error {
+	select {
+	case <-s.sub.finished:
+		return s.sub.reason()
+	default:
+		return nil
+	}
+}
+
+// Dropped gives how many messages were dropped because the consumer fell behind, see WithQueueLimit
+func (s Subscription) Dropped() int {
+	s.sub.mu.Lock()
+	defer s.sub.mu.Unlock()
+
+	return s.sub.dropped
+}
+
+// Next waits for the next message from the feed
+// Returns the reason the subscription ended once there are no more messages, or the context's error if it is done first
+func (s Subscription) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case m, ok := <-s.Messages:
+		if !ok {
+			<-s.sub.finished
+			return nil, s.sub.reason()
+		}
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SubscribeOption configures a Subscription as it is created
+type SubscribeOption func(s *subscriber)
+
+// WithMessageTypes only delivers chat events of the given types, such as MessageTypeGift
+func WithMessageTypes(types ...string) SubscribeOption {
+	allowed := make(map[string]bool, len(types))
+
+	for _, t := range types {
+		allowed[t] = true
+	}
+
+	return WithFilter(func(m StreamMessage) bool {
+		return allowed[m.Type]
+	})
+}
+
+// WithFilter only delivers chat events the filter keeps
+// When given more than once, events must be kept by every filter
+func WithFilter(filter MessageFilter) SubscribeOption {
+	return func(s *subscriber) {
+		if s.filter == nil {
+			s.filter = filter
+			return
+		}
+
+		previous := s.filter
+
+		s.filter = func(m StreamMessage) bool {
+			return previous(m) && filter(m)
+		}
+	}
+}
+
+// WithQueueLimit sets how many messages are held for the consumer before the oldest are dropped, DefaultQueueLimit if not given
+func WithQueueLimit(limit int) SubscribeOption {
+	return func(s *subscriber) {
+		if limit > 0 {
+			s.limit = limit
+		}
+	}
+}
+
+// WithHistory delivers the feed's recent chat events before any live data
+// At most limit events are replayed, 0 replays everything the feed has kept
+// Replayed events are filtered like live ones, and no event is missed or repeated between the two
+func WithHistory(limit int) SubscribeOption {
+	return func(s *subscriber) {
+		s.replay = true
+		s.replayLimit = limit
+	}
+}
+
+// subscriber is the feed's side of a Subscription
+// Published data is queued without blocking the feed, and a goroutine hands the queue to the consumer in order
+type subscriber struct {
+	mu       sync.Mutex
+	queue    [][]byte      // Data waiting to be read by the consumer
+	limit    int           // Most data queued, the oldest is dropped to make room
+	dropped  int           // How much data has been dropped
+	behind   bool          // Set while the queue is full, so falling behind is only reported once
+	ended    bool          // Set once the feed has stopped, the queue is drained before the output channel closes
+	err      error         // Why the subscription ended, the first reason given wins
+	notify   chan struct{} // Wakes the delivery goroutine when the queue or ended flag changes
+	done     chan struct{} // Closed when the consumer unsubscribes, pending data is discarded
+	out      chan []byte   // The channel handed to the consumer
+	finished chan struct{} // Closed after the output channel, once the err is final
+	once     sync.Once
+	filter   MessageFilter // Chat events the consumer is interested in, nil for everything
+
+	replay      bool // If the feed's history should be queued before live data
+	replayLimit int  // Maximum number of events to replay, 0 for all of them
+}
+
+func newSubscriber(opts ...SubscribeOption) *subscriber {
+	s := &subscriber{
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		out:      make(chan []byte),
+		finished: make(chan struct{}),
+		limit:    DefaultQueueLimit,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// push queues data for the consumer, dropping the oldest if the queue is full
+// Reports true when the consumer has just fallen behind, not for every drop after that
+func (s *subscriber) push(p []byte) (behind bool) {
+	s.mu.Lock()
+
+	if len(s.queue) >= s.limit {
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.dropped++
+		behind = !s.behind
+		s.behind = true
+	}
+
+	s.queue = append(s.queue, p)
+	s.mu.Unlock()
+
+	s.wake()
+
+	return behind
+}
+
+// end marks that no more data will be queued, the output channel is closed once the queue is drained
+func (s *subscriber) end(reason error) {
+	s.mu.Lock()
+	s.ended = true
+	s.setReason(reason)
+	s.mu.Unlock()
+
+	s.wake()
+}
+
+// stop discards any pending data and closes the output channel as soon as possible
+func (s *subscriber) stop(reason error) {
+	s.mu.Lock()
+	s.setReason(reason)
+	s.mu.Unlock()
+
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// setReason records why the subscription ended unless a reason was already given, the lock must be held
+func (s *subscriber) setReason(reason error) {
+	if s.err == nil {
+		s.err = reason
+	}
+}
+
+func (s *subscriber) reason() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *subscriber) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the oldest queued data
+// ok is false when the queue is empty, ended reports if the feed has stopped
+func (s *subscriber) next() (p []byte, ok bool, ended bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil, false, s.ended
+	}
+
+	p = s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.behind = false
+
+	return p, true, s.ended
+}
+
+// deliver writes queued data to the output channel until the subscriber is stopped or the feed has ended and the queue is empty
+func (s *subscriber) deliver() {
+	defer close(s.finished)
+	defer close(s.out)
+
+	for {
+		p, ok, ended := s.next()
+
+		if !ok {
+			if ended {
+				return
+			}
+
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case s.out <- p:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// alertTickInterval is how often a running Alerts checks for gift combos that have ended
+const alertTickInterval = time.Second
+
+// alertSeenLimit is how many event IDs Alerts remembers, so replayed events aren't thanked twice
+const alertSeenLimit = 1000
+
+// DefaultComboWindow is how long Alerts waits for more of a gift combo when the gift doesn't say how long its combo lasts
+const DefaultComboWindow = 10 * time.Second
+
+// Default templates for each kind of alert
+const (
+	DefaultGiftTemplate         = "Thanks {{.Displayname}} for {{.Amount}} {{.GiftName}}!"
+	DefaultFollowTemplate       = "Thanks for the follow {{.Displayname}}!"
+	DefaultSubscriptionTemplate = "Thanks {{.Displayname}} for subscribing{{if gt .Months 1}} for {{.Months}} months{{end}}!"
+	DefaultHostTemplate         = "Thanks {{.Displayname}} for hosting with {{.Viewers}} viewers!"
+)
+
+// giftNames are how gifts are written in alerts, singular and plural
+var giftNames = map[string][2]string{
+	api.GiftLemon:      {"lemon", "lemons"},
+	api.GiftIceCream:   {"ice cream", "ice creams"},
+	api.GiftDiamond:    {"diamond", "diamonds"},
+	api.GiftNinjaghini: {"ninjaghini", "ninjaghinis"},
+	api.GiftNinjet:     {"ninjet", "ninjets"},
+}
+
+// AlertData is what alert templates are given
+type AlertData struct {
+	Type        string // The chat event type, such as api.MessageTypeGift
+	Username    string
+	Displayname string // The sender's display name, or username if they have none
+	Gift        string // The gift type, such as api.GiftLemon
+	GiftName    string // How the gift is written, plural if more than one was given
+	Amount      int64  // How many gifts were given, summed over the whole combo
+	Lemons      int64  // What the gifts are worth in lemons
+	Months      int64  // How many months a subscription is for
+	Viewers     int    // How many viewers a host brought
+}
+
+// combo is a run of gifts of the same kind from one sender, waiting to be thanked
+type combo struct {
+	data     AlertData
+	deadline time.Time // When the combo ends if no more gifts are given
+}
+
+// Alerts thanks viewers in chat for gifts, follows, subscriptions, and hosts
+// Gifts of the same kind from one sender are merged while their combo lasts, and thanked once it ends
+type Alerts struct {
+	Chat        Chat
+	ComboWindow time.Duration // Used when a gift doesn't say how long its combo lasts, DefaultComboWindow if 0
+	Logger      api.Logger    // Where failed alerts are reported, silent if nil
+
+	mu        sync.Mutex
+	templates map[string]*template.Template // By chat event type
+	combos    map[string]*combo             // By sender ID and gift type
+	seen      *recentIDs
+	now       func() time.Time
+}
+
+// NewAlerts creates an Alerts using the default templates
+func NewAlerts(chat Chat) *Alerts {
+	a := &Alerts{
+		Chat:      chat,
+		templates: make(map[string]*template.Template),
+		combos:    make(map[string]*combo),
+		seen:      newRecentIDs(alertSeenLimit),
+		now:       time.Now,
+	}
+
+	defaults := map[string]string{
+		api.MessageTypeGift:         DefaultGiftTemplate,
+		api.MessageTypeFollow:       DefaultFollowTemplate,
+		api.MessageTypeSubscription: DefaultSubscriptionTemplate,
+		api.MessageTypeHost:         DefaultHostTemplate,
+	}
+
+	for t, text := range defaults {
+		a.templates[t] = template.Must(template.New(t).Parse(text))
+	}
+
+	return a
+}
+
+// SetTemplate sets the template used for a chat event type, see AlertData for what it is given
+// An empty template turns off alerts for the type
+func (a *Alerts) SetTemplate(messageType string, text string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if text == "" {
+		delete(a.templates, messageType)
+		return nil
+	}
+
+	t, err := template.New(messageType).Parse(text)
+
+	if err != nil {
+		return err
+	}
+
+	a.templates[messageType] = t
+
+	return nil
+}
+
+// HandleMessage sends an alert for the chat event, or adds a gift to its sender's combo
+func (a *Alerts) HandleMessage(m api.StreamMessage) {
+	switch m.Type {
+	case api.MessageTypeGift, api.MessageTypeFollow, api.MessageTypeSubscription, api.MessageTypeHost:
+	default:
+		return
+	}
+
+	a.mu.Lock()
+
+	if _, ok := a.templates[m.Type]; !ok || (m.ID != "" && !a.seen.add(m.ID)) {
+		a.mu.Unlock()
+		return
+	}
+
+	data := alertData(m)
+
+	if m.Type != api.MessageTypeGift {
+		a.mu.Unlock()
+		a.send(data)
+		return
+	}
+
+	window := time.Duration(m.ExpireDuration) * time.Second
+
+	if window <= 0 {
+		window = a.ComboWindow
+	}
+
+	if window <= 0 {
+		window = DefaultComboWindow
+	}
+
+	key := m.Sender.ID + "\x00" + m.Gift
+	c, ok := a.combos[key]
+
+	var ended *AlertData
+
+	// A recent count no more than this gift's amount means DLive started a new combo, even if ours hasn't timed out
+	if ok && m.RecentCount > 0 && int64(m.RecentCount) <= data.Amount {
+		ended = &c.data
+		ok = false
+	}
+
+	if !ok {
+		c = &combo{data: data}
+		a.combos[key] = c
+	} else {
+		c.data.Amount += data.Amount
+		c.data.Lemons += data.Lemons
+	}
+
+	// DLive's count covers gifts given before we joined or that we missed
+	if recent := int64(m.RecentCount); recent > c.data.Amount && data.Amount > 0 {
+		c.data.Lemons = c.data.Lemons / c.data.Amount * recent
+		c.data.Amount = recent
+	}
+
+	c.data.GiftName = giftName(m.Gift, c.data.Amount)
+	c.deadline = a.now().Add(window)
+	a.mu.Unlock()
+
+	if ended != nil {
+		a.send(*ended)
+	}
+}
+
+// Flush thanks every gift combo that has ended, or every one if all is true
+func (a *Alerts) Flush(all bool) {
+	now := a.now()
+
+	var ended []AlertData
+
+	a.mu.Lock()
+
+	for k, c := range a.combos {
+		if all || !now.Before(c.deadline) {
+			ended = append(ended, c.data)
+			delete(a.combos, k)
+		}
+	}
+
+	a.mu.Unlock()
+
+	for _, d := range ended {
+		a.send(d)
+	}
+}
+
+// Run thanks gift combos as they end, until the context is done
+// Combos still open when the context is done are thanked before returning
+func (a *Alerts) Run(ctx context.Context) error {
+	t := time.NewTicker(alertTickInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.Flush(true)
+			return ctx.Err()
+		case <-t.C:
+			a.Flush(false)
+		}
+	}
+}
+
+// send renders the alert's template and posts it in chat
+func (a *Alerts) send(d AlertData) {
+	a.mu.Lock()
+	t, ok := a.templates[d.Type]
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var b bytes.Buffer
+
+	if err := t.Execute(&b, d); err != nil {
+		logger(a.Logger).Error("unable to render alert", "type", d.Type, "error", err)
+		return
+	}
+
+	if err := a.Chat.Say(strings.TrimSpace(b.String())); err != nil {
+		logger(a.Logger).Warn("unable to send alert", "type", d.Type, "user", d.Username, "error", err)
+	}
+}
+
+func alertData(m api.StreamMessage) AlertData {
+	d := AlertData{
+		Type:        m.Type,
+		Username:    m.Sender.Username,
+		Displayname: m.Sender.Displayname,
+		Viewers:     m.Viewer,
+	}
+
+	if d.Displayname == "" {
+		d.Displayname = d.Username
+	}
+
+	switch m.Type {
+	case api.MessageTypeGift:
+		d.Gift = m.Gift
+		d.Amount, _ = m.Amount.Int64()
+		d.Lemons = m.Lemons()
+		d.GiftName = giftName(m.Gift, d.Amount)
+	case api.MessageTypeSubscription:
+		d.Months = m.Months()
+	}
+
+	return d
+}
+
+// giftName gives how the gift is written, plural unless there is exactly one
+func giftName(gift string, amount int64) string {
+	names, ok := giftNames[gift]
+
+	if !ok {
+		return strings.ToLower(strings.ReplaceAll(gift, "_", " "))
+	}
+
+	if amount == 1 {
+		return names[0]
+	}
+
+	return names[1]
+}
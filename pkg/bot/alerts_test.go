@@ -0,0 +1,87 @@
+package bot
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestAlerts(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	a := NewAlerts(Chat{Sender: sender})
+	a.now = clock.Now
+
+	if err := a.SetTemplate(api.MessageTypeHost, ""); err != nil {
+		t.Fatalf("failed to turn off host alerts: %s", err)
+	}
+
+	alice := api.Sender{ID: "1", Username: "alice", Displayname: "Alice"}
+	bob := api.Sender{ID: "2", Username: "bob"}
+
+	gift := func(id, amount string, expire int) api.StreamMessage {
+		return api.StreamMessage{Type: api.MessageTypeGift, ID: id, Gift: api.GiftLemon, Amount: json.Number(amount), ExpireDuration: expire, Sender: alice}
+	}
+
+	a.HandleMessage(gift("g1", "10", 5))
+	a.HandleMessage(gift("g1", "10", 5)) // Replayed
+	clock.Advance(4 * time.Second)
+	a.HandleMessage(gift("g2", "15", 5))
+	a.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, ID: "f1", Sender: bob})
+	a.HandleMessage(api.StreamMessage{Type: api.MessageTypeHost, ID: "h1", Viewer: 10, Sender: bob})
+
+	clock.Advance(4 * time.Second)
+	a.Flush(false)
+
+	want := []string{"Thanks for the follow bob!"}
+
+	if !reflect.DeepEqual(sender.messages(), want) {
+		t.Fatalf("expected %q before the combo ends, got %q", want, sender.messages())
+	}
+
+	clock.Advance(time.Second)
+	a.Flush(false)
+
+	want = append(want, "Thanks Alice for 25 lemons!")
+
+	if !reflect.DeepEqual(sender.messages(), want) {
+		t.Errorf("expected %q once the combo ends, got %q", want, sender.messages())
+	}
+}
+
+func TestAlerts_RecentCount(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	a := NewAlerts(Chat{Sender: sender})
+	a.now = clock.Now
+
+	gift := func(id, amount string, recent int) api.StreamMessage {
+		return api.StreamMessage{Type: api.MessageTypeGift, ID: id, Gift: api.GiftLemon, Amount: json.Number(amount), RecentCount: recent, Sender: api.Sender{ID: "1", Username: "alice"}}
+	}
+
+	// The first gifts of the combo were given before the alerts started
+	a.HandleMessage(gift("g1", "5", 20))
+	a.HandleMessage(gift("g2", "5", 25))
+
+	// A new combo starts before ours times out
+	a.HandleMessage(gift("g3", "2", 2))
+
+	want := []string{"Thanks alice for 25 lemons!"}
+
+	if !reflect.DeepEqual(sender.messages(), want) {
+		t.Fatalf("expected %q once DLive starts a new combo, got %q", want, sender.messages())
+	}
+
+	a.Flush(true)
+
+	want = append(want, "Thanks alice for 2 lemons!")
+
+	if !reflect.DeepEqual(sender.messages(), want) {
+		t.Errorf("expected %q, got %q", want, sender.messages())
+	}
+}
@@ -0,0 +1,203 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// announcePollInterval is how often a running Announcer checks if an announcement is due
+const announcePollInterval = 5 * time.Second
+
+// ChatRoomInfoClient looks up a streamer's chat settings, an *api.Client satisfies it
+type ChatRoomInfoClient interface {
+	LivestreamChatRoomInfo(args api.LivestreamChatRoomInfoArgs) (api.Response, error)
+}
+
+// ChatInterval looks up the slow mode setting of a streamer's chat, 0 if slow mode is off
+func ChatInterval(client ChatRoomInfoClient, displayname string) (time.Duration, error) {
+	resp, err := client.LivestreamChatRoomInfo(api.LivestreamChatRoomInfoArgs{
+		DisplayName: displayname,
+		IsLoggedIn:  false,
+		Limit:       1,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	user, ok := resp.Data["userByDisplayName"].(map[string]interface{})
+
+	if !ok {
+		return 0, fmt.Errorf("no user found with displayname (%s)", displayname)
+	}
+
+	seconds, _ := user["chatInterval"].(float64)
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Announcer posts a rotating list of messages to chat on a timer
+// An announcement is only posted once enough chat lines have been sent since the last one, and never while the stream is offline
+type Announcer struct {
+	Chat     Chat
+	Messages []string         // Posted in order, starting over after the last one
+	Interval time.Duration    // Least amount of time between announcements
+	MinLines int              // Chat lines needed since the last announcement before another is posted
+	Self     string           // The bot account's username, its own messages don't count as chat lines
+	Streamer string           // Display name of the streamer, used to check if the stream is live when Run starts
+	Info     StreamInfoClient // Used to check if the stream is live when Run starts, it is assumed live if nil
+	Logger   api.Logger       // Where failed announcements are reported, silent if nil
+
+	sending   sync.Mutex // Held while an announcement is posted, so only one is posted at a time
+	mu        sync.Mutex
+	next      int           // Index of the next message to post
+	lines     int           // Chat lines since the last announcement
+	last      time.Time     // When the last announcement was posted, or the announcer started
+	lastSpoke time.Time     // When the bot account last sent a chat line
+	slowMode  time.Duration // Least amount of time between the bot account's chat lines
+	offline   bool
+	now       func() time.Time
+}
+
+// NewAnnouncer creates an Announcer that posts the messages in chat every interval
+func NewAnnouncer(chat Chat, interval time.Duration, messages ...string) *Announcer {
+	return &Announcer{
+		Chat:     chat,
+		Messages: messages,
+		Interval: interval,
+		now:      time.Now,
+	}
+}
+
+// SetSlowMode sets how often the chat allows the bot account to send messages, see ChatInterval
+// Slow mode is ignored if the bot account is a moderator or the streamer
+func (a *Announcer) SetSlowMode(interval time.Duration) {
+	a.mu.Lock()
+	a.slowMode = interval
+	a.mu.Unlock()
+}
+
+// SetLive pauses announcements while the stream is offline, and resumes them once it is live again
+// HandleMessage does this automatically when the stream's chat reports going live or offline
+func (a *Announcer) SetLive(live bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.offline && live {
+		// Start counting afresh, so the first announcement isn't posted the moment the stream starts
+		a.last = a.now()
+		a.lines = 0
+	}
+
+	a.offline = !live
+}
+
+// HandleMessage counts chat lines and follows the stream going live or offline
+func (a *Announcer) HandleMessage(m api.StreamMessage) {
+	switch m.Type {
+	case api.MessageTypeLive:
+		a.SetLive(true)
+	case api.MessageTypeOffline:
+		a.SetLive(false)
+	case api.MessageTypeText:
+		a.mu.Lock()
+		if sameUser(m, a.Self) {
+			a.lastSpoke = a.now()
+		} else {
+			a.lines++
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Announce posts the next message if one is due
+// Returns true if a message was posted
+func (a *Announcer) Announce() (bool, error) {
+	a.sending.Lock()
+	defer a.sending.Unlock()
+
+	a.mu.Lock()
+
+	if !a.due() {
+		a.mu.Unlock()
+		return false, nil
+	}
+
+	message := a.Messages[a.next%len(a.Messages)]
+	a.mu.Unlock()
+
+	if err := a.Chat.Say(message); err != nil {
+		logger(a.Logger).Warn("announcement failed", "error", err)
+		return false, err
+	}
+
+	a.mu.Lock()
+	a.next = (a.next + 1) % len(a.Messages)
+	a.lines = 0
+	a.last = a.now()
+	a.lastSpoke = a.last
+	a.mu.Unlock()
+
+	return true, nil
+}
+
+// Run posts announcements as they become due, until the context is done
+// Live and offline events are only seen as they happen, so the stream's current state is looked up first if Info is set
+func (a *Announcer) Run(ctx context.Context) error {
+	a.checkLive()
+
+	a.mu.Lock()
+	if a.last.IsZero() {
+		a.last = a.now()
+	}
+	a.mu.Unlock()
+
+	t := time.NewTicker(announcePollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			_, _ = a.Announce()
+		}
+	}
+}
+
+// checkLive looks up if the stream is live, leaving the state as it is if it can't be found
+func (a *Announcer) checkLive() {
+	if a.Info == nil {
+		return
+	}
+
+	info, err := FetchStreamInfo(a.Info, a.Streamer)
+
+	if err != nil {
+		logger(a.Logger).Warn("unable to check if the stream is live", "streamer", a.Streamer, "error", err)
+		return
+	}
+
+	a.SetLive(info.Live)
+}
+
+// due reports if an announcement should be posted, the lock must be held
+func (a *Announcer) due() bool {
+	if a.offline || len(a.Messages) == 0 || a.lines < a.MinLines {
+		return false
+	}
+
+	now := a.now()
+
+	if now.Sub(a.last) < a.Interval {
+		return false
+	}
+
+	exempt := a.Chat.RoomRole == api.RoomRoleModerator || a.Chat.RoomRole == api.RoomRoleOwner
+
+	return exempt || a.lastSpoke.IsZero() || now.Sub(a.lastSpoke) >= a.slowMode
+}
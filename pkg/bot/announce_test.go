@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestAnnouncer_Announce(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	a := NewAnnouncer(Chat{Sender: sender}, time.Minute, "first", "second")
+	a.MinLines = 2
+	a.Self = "bot"
+	a.now = clock.Now
+	a.last = clock.Now()
+	a.SetSlowMode(time.Hour)
+
+	chat := func(n int) {
+		for i := 0; i < n; i++ {
+			a.HandleMessage(chatMessage("1", "viewer", "hello"))
+		}
+	}
+
+	steps := []struct {
+		name  string
+		setup func()
+		want  bool
+	}{
+		{"too soon", func() { chat(2) }, false},
+		{"due", func() { clock.Advance(time.Minute) }, true},
+		{"quiet chat", func() { clock.Advance(time.Minute); chat(1) }, false},
+		{"slow mode", func() { chat(1) }, false},
+		{"slow mode passed", func() { clock.Advance(time.Hour) }, true},
+		{"offline", func() {
+			clock.Advance(time.Hour)
+			chat(2)
+			a.HandleMessage(api.StreamMessage{Type: api.MessageTypeOffline})
+		}, false},
+		{"back live", func() { a.HandleMessage(api.StreamMessage{Type: api.MessageTypeLive}); chat(2) }, false},
+		{"due after live", func() { clock.Advance(time.Hour) }, true},
+	}
+
+	for _, s := range steps {
+		s.setup()
+
+		if got, err := a.Announce(); got != s.want || err != nil {
+			t.Errorf("%s: expected announcement: %v, got %v (%v)", s.name, s.want, got, err)
+		}
+	}
+
+	if want := []string{"first", "second", "first"}; !reflect.DeepEqual(sender.messages(), want) {
+		t.Errorf("expected announcements %q, got %q", want, sender.messages())
+	}
+}
+
+func TestAnnouncer_RunOffline(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	a := NewAnnouncer(Chat{Sender: sender}, time.Minute, "hello")
+	a.Streamer = "streamer"
+	a.Info = &fakeStreamInfo{offline: true}
+	a.now = clock.Now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The stream was already offline when the announcer started, no offline event will come
+	_ = a.Run(ctx)
+
+	clock.Advance(time.Hour)
+
+	if got, _ := a.Announce(); got {
+		t.Error("expected no announcement while the stream is offline")
+	}
+
+	a.HandleMessage(api.StreamMessage{Type: api.MessageTypeLive})
+	clock.Advance(time.Hour)
+
+	if got, err := a.Announce(); !got || err != nil {
+		t.Errorf("expected an announcement once live, got %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package bot builds chat bots on top of the DLive API client
+// Features react to chat events from a StreamMessageFeed subscription, and talk back using SendStreamChat
+package bot
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// sendStreamChatField is the mutation field DLive reports chat sending errors in
+const sendStreamChatField = "sendStreamchatMessage"
+
+// ChatSender sends messages to a streamer's chat, an *api.Client satisfies it
+type ChatSender interface {
+	SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error)
+}
+
+// Chat is a streamer's chat the bot talks in
+type Chat struct {
+	Sender      ChatSender // Used to send messages
+	Streamer    string     // The streamer whose chat messages are sent to
+	RoomRole    string     // The bot account's role in the streamer's chat, such as api.RoomRoleModerator
+	Subscribing bool       // If the bot account is subscribed to the streamer
+}
+
+// Say sends a message to the chat
+// Returns an error if the request failed, or DLive refused the message
+func (c Chat) Say(message string) error {
+	resp, err := c.Sender.SendStreamChat(api.SendStreamChatMessageArgs{
+		Input: api.SendStreamChatMessageInput{
+			Message:     message,
+			RoomRole:    c.RoomRole,
+			Streamer:    c.Streamer,
+			Subscribing: c.Subscribing,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return resp.MutationError(sendStreamChatField)
+}
+
+// Run decodes the chat events read from the subscription and hands each one to the handler
+// Returns the reason the subscription ended, or the context's error if it is done first
+func Run(ctx context.Context, s *api.Subscription, handler func(m api.StreamMessage)) error {
+	for {
+		p, err := s.Next(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		messages, err := api.DecodeStreamMessages(p)
+
+		if err != nil {
+			continue
+		}
+
+		for _, m := range messages {
+			handler(m)
+		}
+	}
+}
+
+// sameUser reports if the event was sent by the given user, compared by username ignoring case
+func sameUser(m api.StreamMessage, username string) bool {
+	return username != "" && strings.EqualFold(m.Sender.Username, username)
+}
+
+// logger gives l, or one that discards everything if l is nil
+func logger(l api.Logger) api.Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+
+	return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// recentIDs remembers up to limit event IDs, forgetting the oldest first
+// It is used to skip events seen again when a feed reconnects or replays its history
+type recentIDs struct {
+	limit int
+	set   map[string]bool
+	order []string // Oldest first
+}
+
+func newRecentIDs(limit int) *recentIDs {
+	return &recentIDs{limit: limit, set: make(map[string]bool)}
+}
+
+// add remembers the ID, returning false if it was already known
+func (r *recentIDs) add(id string) bool {
+	if r.set[id] {
+		return false
+	}
+
+	r.set[id] = true
+	r.order = append(r.order, id)
+
+	if len(r.order) > r.limit {
+		delete(r.set, r.order[0])
+		r.order[0] = ""
+		r.order = r.order[1:]
+	}
+
+	return true
+}
+
+// has reports if the ID is known
+func (r *recentIDs) has(id string) bool {
+	return r.set[id]
+}
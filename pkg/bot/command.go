@@ -0,0 +1,366 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultPrefix is what commands start with if a Router is given no prefix
+const DefaultPrefix = "!"
+
+// Permission is the minimum standing a chatter needs to use a command
+type Permission int
+
+const (
+	PermissionEveryone   Permission = iota // Anyone in chat
+	PermissionSubscriber                   // Subscribers, moderators, and the streamer
+	PermissionModerator                    // Moderators and the streamer
+	PermissionOwner                        // Only the streamer
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionEveryone:
+		return "everyone"
+	case PermissionSubscriber:
+		return "subscriber"
+	case PermissionModerator:
+		return "moderator"
+	case PermissionOwner:
+		return "owner"
+	default:
+		return fmt.Sprintf("permission(%d)", int(p))
+	}
+}
+
+// PermissionOf gives the standing of the sender of a chat event, based on their role and subscription
+// The sender's room role is used, falling back to their role when the event doesn't include one
+func PermissionOf(m api.StreamMessage) Permission {
+	role := m.RoomRole
+
+	if role == "" {
+		role = m.Role
+	}
+
+	switch role {
+	case api.RoomRoleOwner:
+		return PermissionOwner
+	case api.RoomRoleModerator:
+		return PermissionModerator
+	}
+
+	if m.Subscribing {
+		return PermissionSubscriber
+	}
+
+	return PermissionEveryone
+}
+
+// CommandFunc handles a command sent in chat
+type CommandFunc func(c *CommandContext) error
+
+// Command is a chat command a Router dispatches to its handler
+type Command struct {
+	Name         string        // What the command is called, without the prefix
+	Aliases      []string      // Other names the command can be called by
+	Description  string        // Short explanation of what the command does
+	Permission   Permission    // Minimum standing needed to use the command
+	Cooldown     time.Duration // How long after any use before the command can be used again
+	UserCooldown time.Duration // How long after a chatter's use before that chatter can use it again
+	Handler      CommandFunc
+}
+
+// CommandContext is a single use of a command
+type CommandContext struct {
+	Chat    Chat              // The chat the command was sent in, replies are sent here
+	Message api.StreamMessage // The chat message holding the command
+	Command *Command          // The command being used
+	Name    string            // The name the command was called by, which may be an alias
+	Args    []string          // The arguments following the command, quoted arguments may contain spaces
+}
+
+// Reply sends a message to the chat the command was sent in
+func (c *CommandContext) Reply(message string) error {
+	return c.Chat.Say(message)
+}
+
+// Arg gives the argument at index i, or an empty string if there aren't that many
+func (c *CommandContext) Arg(i int) string {
+	if i < 0 || i >= len(c.Args) {
+		return ""
+	}
+
+	return c.Args[i]
+}
+
+// RawArgs gives everything after the command name, as it was typed
+func (c *CommandContext) RawArgs() string {
+	content := strings.TrimSpace(c.Message.Content)
+
+	if i := strings.IndexFunc(content, unicode.IsSpace); i >= 0 {
+		return strings.TrimSpace(content[i:])
+	}
+
+	return ""
+}
+
+// Router parses chat messages for prefixed commands, and dispatches them to the registered handlers
+// Moderators and the streamer are not subject to cooldowns
+type Router struct {
+	Chat    Chat       // Where replies are sent
+	Prefix  string     // What commands start with, DefaultPrefix if empty
+	Self    string     // The bot account's username, its own messages are never treated as commands
+	Logger  api.Logger // Where handler errors are reported, silent if nil
+	OnError func(c *CommandContext, err error)
+
+	mu         sync.Mutex
+	commands   map[string]*Command   // Every command by name and alias, lower case
+	last       map[string]commandUse // When each command was last used
+	lastByUser map[string]commandUse // When each command was last used by each chatter
+	sweep      int                   // Number of uses remembered that triggers the next sweep
+	now        func() time.Time
+}
+
+// cooldownSweepSize is how many uses a Router remembers before it drops the ones whose cooldown is over
+const cooldownSweepSize = 1024
+
+// commandUse is when a command was used, kept until its cooldown is over
+type commandUse struct {
+	at      time.Time
+	expires time.Time // When the cooldown ends, after which the use can be forgotten
+}
+
+// NewRouter creates a Router that replies in the given chat
+func NewRouter(chat Chat) *Router {
+	return &Router{
+		Chat:       chat,
+		commands:   make(map[string]*Command),
+		last:       make(map[string]commandUse),
+		lastByUser: make(map[string]commandUse),
+		sweep:      cooldownSweepSize,
+		now:        time.Now,
+	}
+}
+
+// Handle registers a command
+// Returns an error if the command has no handler, or any of its names are already taken
+func (r *Router) Handle(cmd Command) error {
+	if cmd.Handler == nil {
+		return fmt.Errorf("command (%s) has no handler", cmd.Name)
+	}
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, n := range names {
+		if n == "" || strings.IndexFunc(n, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("command (%s) has an invalid name (%s)", cmd.Name, n)
+		}
+
+		if _, ok := r.commands[strings.ToLower(n)]; ok {
+			return fmt.Errorf("command name (%s) is already registered", n)
+		}
+	}
+
+	c := &cmd
+
+	for _, n := range names {
+		r.commands[strings.ToLower(n)] = c
+	}
+
+	return nil
+}
+
+// Remove unregisters the command with the given name or alias, along with all its other names
+func (r *Router) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.commands[strings.ToLower(name)]
+
+	if !ok {
+		return
+	}
+
+	for k, v := range r.commands {
+		if v == c {
+			delete(r.commands, k)
+		}
+	}
+
+	delete(r.last, c.Name)
+}
+
+// Commands gives every registered command once, regardless of how many aliases it has
+func (r *Router) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[*Command]bool)
+
+	var commands []Command
+
+	for _, c := range r.commands {
+		if !seen[c] {
+			seen[c] = true
+			commands = append(commands, *c)
+		}
+	}
+
+	return commands
+}
+
+// Parse splits a chat message into a command name and its arguments
+// Returns false if the message doesn't start with the router's prefix
+func (r *Router) Parse(content string) (name string, args []string, ok bool) {
+	prefix := r.Prefix
+
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	content = strings.TrimSpace(content)
+
+	if !strings.HasPrefix(content, prefix) {
+		return "", nil, false
+	}
+
+	fields := splitArgs(strings.TrimPrefix(content, prefix))
+
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	return fields[0], fields[1:], true
+}
+
+// HandleMessage dispatches the chat event if it is a command the sender is allowed to use
+// Returns true if a command handler was run
+func (r *Router) HandleMessage(m api.StreamMessage) bool {
+	if m.Type != api.MessageTypeText || sameUser(m, r.Self) {
+		return false
+	}
+
+	name, args, ok := r.Parse(m.Content)
+
+	if !ok {
+		return false
+	}
+
+	r.mu.Lock()
+
+	cmd, ok := r.commands[strings.ToLower(name)]
+
+	if !ok || PermissionOf(m) < cmd.Permission || !r.ready(cmd, m) {
+		r.mu.Unlock()
+		return false
+	}
+
+	r.mu.Unlock()
+
+	c := &CommandContext{
+		Chat:    r.Chat,
+		Message: m,
+		Command: cmd,
+		Name:    name,
+		Args:    args,
+	}
+
+	if err := cmd.Handler(c); err != nil {
+		logger(r.Logger).Warn("command failed", "command", cmd.Name, "sender", m.Sender.Username, "error", err)
+
+		if r.OnError != nil {
+			r.OnError(c, err)
+		}
+	}
+
+	return true
+}
+
+// ready checks the command's cooldowns for the sender, marking the command as used if it is ready
+// The router's lock must be held
+func (r *Router) ready(cmd *Command, m api.StreamMessage) bool {
+	now := r.now()
+	userKey := cmd.Name + ":" + m.Sender.ID
+
+	if PermissionOf(m) < PermissionModerator {
+		if last, ok := r.last[cmd.Name]; ok && now.Sub(last.at) < cmd.Cooldown {
+			return false
+		}
+
+		if last, ok := r.lastByUser[userKey]; ok && now.Sub(last.at) < cmd.UserCooldown {
+			return false
+		}
+	}
+
+	// Uses only matter while their cooldown lasts
+	if cmd.Cooldown > 0 {
+		r.last[cmd.Name] = commandUse{at: now, expires: now.Add(cmd.Cooldown)}
+	}
+
+	if cmd.UserCooldown > 0 {
+		r.lastByUser[userKey] = commandUse{at: now, expires: now.Add(cmd.UserCooldown)}
+	}
+
+	if len(r.last)+len(r.lastByUser) >= r.sweep {
+		r.forgetUses(now)
+	}
+
+	return true
+}
+
+// forgetUses drops the uses whose cooldown is over, the lock must be held
+func (r *Router) forgetUses(now time.Time) {
+	for _, uses := range []map[string]commandUse{r.last, r.lastByUser} {
+		for k, u := range uses {
+			if !now.Before(u.expires) {
+				delete(uses, k)
+			}
+		}
+	}
+
+	r.sweep = 2 * (len(r.last) + len(r.lastByUser))
+
+	if r.sweep < cooldownSweepSize {
+		r.sweep = cooldownSweepSize
+	}
+}
+
+// splitArgs splits on whitespace, keeping text within double quotes together
+func splitArgs(s string) []string {
+	var args []string
+	var current strings.Builder
+
+	quoted := false
+	started := false
+
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			started = true
+		case unicode.IsSpace(c) && !quoted:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(c)
+			started = true
+		}
+	}
+
+	if started {
+		args = append(args, current.String())
+	}
+
+	return args
+}
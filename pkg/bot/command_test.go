@@ -0,0 +1,255 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// fakeSender records every chat message sent through it
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []string
+	resp api.Response
+	err  error
+}
+
+func (f *fakeSender) SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent = append(f.sent, args.Input.Message)
+
+	return f.resp, f.err
+}
+
+func (f *fakeSender) messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.sent...)
+}
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func chatMessage(id, username, content string) api.StreamMessage {
+	return api.StreamMessage{
+		Type:     api.MessageTypeText,
+		Content:  content,
+		RoomRole: api.RoomRoleMember,
+		Sender:   api.Sender{ID: id, Username: username},
+	}
+}
+
+func newTestRouter(sender *fakeSender, clock *fakeClock) *Router {
+	r := NewRouter(Chat{Sender: sender, Streamer: "streamer"})
+	r.Self = "bot"
+	r.now = clock.Now
+
+	return r
+}
+
+func TestRouter_HandleMessage(t *testing.T) {
+	sender := &fakeSender{}
+	r := newTestRouter(sender, newFakeClock())
+
+	var args []string
+
+	err := r.Handle(Command{
+		Name:    "echo",
+		Aliases: []string{"say"},
+		Handler: func(c *CommandContext) error {
+			args = c.Args
+			return c.Reply(c.RawArgs())
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("failed to register command: %s", err)
+	}
+
+	if !r.HandleMessage(chatMessage("1", "viewer", `!SAY hello "big world"`)) {
+		t.Fatal("expected alias to run the command")
+	}
+
+	if want := []string{"hello", "big world"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("expected args %q, got %q", want, args)
+	}
+
+	if want := []string{`hello "big world"`}; !reflect.DeepEqual(sender.messages(), want) {
+		t.Errorf("expected replies %q, got %q", want, sender.messages())
+	}
+
+	ignored := []api.StreamMessage{
+		chatMessage("1", "viewer", "echo no prefix"),
+		chatMessage("1", "viewer", "!unknown"),
+		chatMessage("2", "Bot", "!echo from myself"),
+		{Type: api.MessageTypeGift, Content: "!echo", Sender: api.Sender{ID: "1"}},
+	}
+
+	for _, m := range ignored {
+		if r.HandleMessage(m) {
+			t.Errorf("expected message (%s) from (%s) to be ignored", m.Content, m.Sender.Username)
+		}
+	}
+
+	if err := r.Handle(Command{Name: "repeat", Aliases: []string{"ECHO"}, Handler: func(*CommandContext) error { return nil }}); err == nil {
+		t.Error("expected clashing alias to be refused")
+	}
+}
+
+func TestRouter_Permission(t *testing.T) {
+	r := newTestRouter(&fakeSender{}, newFakeClock())
+
+	ran := 0
+
+	_ = r.Handle(Command{
+		Name:       "mods",
+		Permission: PermissionModerator,
+		Handler: func(*CommandContext) error {
+			ran++
+			return nil
+		},
+	})
+
+	member := chatMessage("1", "viewer", "!mods")
+	subscriber := chatMessage("2", "fan", "!mods")
+	subscriber.Subscribing = true
+	moderator := chatMessage("3", "mod", "!mods")
+	moderator.RoomRole = api.RoomRoleModerator
+	owner := chatMessage("4", "streamer", "!mods")
+	owner.RoomRole = ""
+	owner.Role = api.RoomRoleOwner
+
+	tests := []struct {
+		message api.StreamMessage
+		want    bool
+	}{
+		{member, false},
+		{subscriber, false},
+		{moderator, true},
+		{owner, true},
+	}
+
+	for _, tt := range tests {
+		if got := r.HandleMessage(tt.message); got != tt.want {
+			t.Errorf("expected %s with permission (%s) to run: %v, got %v", tt.message.Sender.Username, PermissionOf(tt.message), tt.want, got)
+		}
+	}
+
+	if ran != 2 {
+		t.Errorf("expected command to run 2 times, ran %d", ran)
+	}
+}
+
+func TestRouter_Cooldown(t *testing.T) {
+	clock := newFakeClock()
+	r := newTestRouter(&fakeSender{}, clock)
+
+	ran := 0
+
+	_ = r.Handle(Command{
+		Name:         "roll",
+		Cooldown:     time.Second,
+		UserCooldown: time.Minute,
+		Handler: func(*CommandContext) error {
+			ran++
+			return nil
+		},
+	})
+
+	alice := chatMessage("1", "alice", "!roll")
+	bob := chatMessage("2", "bob", "!roll")
+	mod := chatMessage("3", "mod", "!roll")
+	mod.RoomRole = api.RoomRoleModerator
+
+	steps := []struct {
+		advance time.Duration
+		message api.StreamMessage
+		want    bool
+	}{
+		{0, alice, true},
+		{0, bob, false},                 // Global cooldown
+		{0, mod, true},                  // Moderators skip cooldowns
+		{2 * time.Second, bob, true},    // Global cooldown has passed
+		{2 * time.Second, alice, false}, // Still in alice's cooldown
+		{time.Minute, alice, true},
+	}
+
+	for i, s := range steps {
+		clock.Advance(s.advance)
+
+		if got := r.HandleMessage(s.message); got != s.want {
+			t.Errorf("step %d: expected %s to run: %v, got %v", i, s.message.Sender.Username, s.want, got)
+		}
+	}
+
+	if ran != 4 {
+		t.Errorf("expected command to run 4 times, ran %d", ran)
+	}
+
+	// Uses are forgotten once their cooldown is over, including those of removed commands
+	for i := 0; i < cooldownSweepSize; i++ {
+		r.HandleMessage(chatMessage(fmt.Sprint("chatter", i), "chatter", "!roll"))
+		clock.Advance(time.Second)
+	}
+
+	if n := len(r.lastByUser); n >= cooldownSweepSize {
+		t.Errorf("expected uses past their cooldown swept, %d remembered", n)
+	}
+
+	r.Remove("roll")
+	clock.Advance(time.Minute)
+
+	_ = r.Handle(Command{Name: "wave", UserCooldown: time.Second, Handler: func(*CommandContext) error { return nil }})
+	r.HandleMessage(chatMessage("1", "alice", "!wave"))
+	r.forgetUses(clock.Now())
+
+	if len(r.last) != 0 || len(r.lastByUser) != 1 {
+		t.Errorf("expected only alice's use of wave remembered, got %d and %d", len(r.last), len(r.lastByUser))
+	}
+}
+
+func TestChat_Say(t *testing.T) {
+	sender := &fakeSender{
+		resp: api.Response{Data: map[string]interface{}{
+			sendStreamChatField: map[string]interface{}{
+				"err": map[string]interface{}{"code": float64(8002), "message": "slow down"},
+			},
+		}},
+	}
+
+	err := Chat{Sender: sender}.Say("hello")
+
+	var me *api.MutationError
+
+	if !errors.As(err, &me) || me.Code != 8002 {
+		t.Fatalf("expected mutation error with code 8002, got %v", err)
+	}
+}
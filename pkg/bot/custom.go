@@ -0,0 +1,480 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultStreamInfoMaxAge is how long CustomCommands reuses stream info before looking it up again
+const DefaultStreamInfoMaxAge = time.Minute
+
+// variablePattern matches a variable in a custom command's response, such as {sender}
+var variablePattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// Duration is a time.Duration read from JSON as a string like "30s", or a number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+
+		if err != nil {
+			return err
+		}
+
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration (%s)", b)
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ParsePermission reads a permission written as everyone, subscriber, moderator, or owner
+func ParsePermission(s string) (Permission, error) {
+	for p := PermissionEveryone; p <= PermissionOwner; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+
+	if s == "" {
+		return PermissionEveryone, nil
+	}
+
+	return PermissionEveryone, fmt.Errorf("unknown permission (%s)", s)
+}
+
+// CustomCommand is a text command defined in a CustomCommands file
+//
+// The response may use these variables:
+//
+//	{sender}     display name of who used the command
+//	{target}     first argument without a leading @, or the sender if there are no arguments
+//	{args}       everything after the command name
+//	{arg1}...    each argument
+//	{counter}    how many times the command has been used, including this time
+//	{streamer}   the streamer's display name
+//	{uptime}     how long the stream has been live
+//	{title}      title of the stream
+//	{viewers}    how many are watching the stream
+//	{followers}  how many follow the streamer
+type CustomCommand struct {
+	Name         string   `json:"name"`
+	Aliases      []string `json:"aliases,omitempty"`
+	Response     string   `json:"response"`
+	Permission   string   `json:"permission,omitempty"` // everyone, subscriber, moderator, or owner
+	Cooldown     Duration `json:"cooldown,omitempty"`
+	UserCooldown Duration `json:"userCooldown,omitempty"`
+}
+
+// customCommandFile is the layout of a CustomCommands file
+type customCommandFile struct {
+	Commands []CustomCommand `json:"commands"`
+}
+
+// CustomCommands registers text commands defined in a JSON file with a Router, reloading them when the file changes
+// A file that fails to load leaves the commands from the last good one in place
+type CustomCommands struct {
+	Path        string           // The JSON file defining the commands
+	Router      *Router          // Where the commands are registered
+	Streamer    string           // Display name of the streamer, used for stream variables
+	Info        StreamInfoClient // Used to fill stream variables, they are left empty if nil
+	InfoMaxAge  time.Duration    // How long stream info is reused, DefaultStreamInfoMaxAge if 0
+	CounterPath string           // JSON file command counters are read from on the first Load and saved to by Run, they are kept in memory only if empty
+	Logger      api.Logger       // Where reload failures are reported, silent if nil
+
+	mu         sync.Mutex
+	registered []Command        // The commands registered from the file
+	modTime    time.Time        // Modification time of the file when it was last loaded
+	size       int64            // Size of the file when it was last loaded
+	counters   map[string]int64 // How many times each command has been used, by name
+	loaded     bool             // If counters have been read from the counter file
+	dirty      bool             // If counters have changed since they were last saved
+	saveMu     sync.Mutex       // Held while writing the counter file, so saves land in order
+	info       StreamInfo
+	infoAt     time.Time
+	now        func() time.Time
+}
+
+// NewCustomCommands creates a CustomCommands registering the commands in the file with the router
+// Set CounterPath before the first Load for counters to be read from it
+func NewCustomCommands(path string, router *Router) *CustomCommands {
+	return &CustomCommands{
+		Path:     path,
+		Router:   router,
+		counters: make(map[string]int64),
+		now:      time.Now,
+	}
+}
+
+// Load reads the file and replaces the registered commands with the ones it defines
+func (c *CustomCommands) Load() error {
+	st, err := os.Stat(c.Path)
+
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(c.Path)
+
+	if err != nil {
+		return err
+	}
+
+	var f customCommandFile
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("unable to read custom commands from (%s): %w", c.Path, err)
+	}
+
+	commands := make([]Command, 0, len(f.Commands))
+
+	for _, cc := range f.Commands {
+		cmd, err := c.command(cc)
+
+		if err != nil {
+			return err
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loaded {
+		if err := c.loadCounters(); err != nil {
+			return err
+		}
+
+		c.loaded = true
+	}
+
+	previous := c.registered
+
+	c.unregister(previous)
+
+	if n, err := c.register(commands); err != nil {
+		// Put the last good commands back
+		c.unregister(commands[:n])
+		_, _ = c.register(previous)
+
+		return err
+	}
+
+	c.registered = commands
+	c.modTime = st.ModTime()
+	c.size = st.Size()
+
+	return nil
+}
+
+// Run reloads the commands whenever the file changes and saves changed counters, checking every interval until the context is done
+// Counters left unsaved are saved once the context is done
+func (c *CustomCommands) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Flush(); err != nil {
+				return err
+			}
+
+			return ctx.Err()
+		case <-t.C:
+			if err := c.Flush(); err != nil {
+				logger(c.Logger).Error("unable to save command counters", "path", c.CounterPath, "error", err)
+			}
+
+			if !c.changed() {
+				continue
+			}
+
+			if err := c.Load(); err != nil {
+				logger(c.Logger).Warn("unable to reload custom commands", "path", c.Path, "error", err)
+
+				// Don't retry the same broken file every tick
+				c.markLoaded()
+			} else {
+				logger(c.Logger).Info("custom commands reloaded", "path", c.Path)
+			}
+		}
+	}
+}
+
+// Flush saves the counters to the counter file if they have changed since they were last saved
+func (c *CustomCommands) Flush() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+
+	if !c.dirty || c.CounterPath == "" {
+		c.mu.Unlock()
+		return nil
+	}
+
+	b, err := json.Marshal(c.counters)
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(c.CounterPath, b)
+	}
+
+	if err != nil {
+		// Try again next time
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// Counter gives how many times the named custom command has been used
+func (c *CustomCommands) Counter(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counters[strings.ToLower(name)]
+}
+
+// changed reports if the file has changed since it was last loaded
+func (c *CustomCommands) changed() bool {
+	st, err := os.Stat(c.Path)
+
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !st.ModTime().Equal(c.modTime) || st.Size() != c.size
+}
+
+// markLoaded records the file's current state as seen
+func (c *CustomCommands) markLoaded() {
+	st, err := os.Stat(c.Path)
+
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.modTime = st.ModTime()
+	c.size = st.Size()
+	c.mu.Unlock()
+}
+
+// register adds the commands to the router, stopping at the first that can't be added
+// Returns how many were added
+func (c *CustomCommands) register(commands []Command) (int, error) {
+	for i, cmd := range commands {
+		if err := c.Router.Handle(cmd); err != nil {
+			return i, fmt.Errorf("custom command (%s): %w", cmd.Name, err)
+		}
+	}
+
+	return len(commands), nil
+}
+
+// unregister removes the commands from the router
+func (c *CustomCommands) unregister(commands []Command) {
+	for _, cmd := range commands {
+		c.Router.Remove(cmd.Name)
+	}
+}
+
+// command turns a definition from the file into a Command
+func (c *CustomCommands) command(cc CustomCommand) (Command, error) {
+	if cc.Name == "" || cc.Response == "" {
+		return Command{}, errors.New("custom commands need a name and a response")
+	}
+
+	permission, err := ParsePermission(cc.Permission)
+
+	if err != nil {
+		return Command{}, fmt.Errorf("custom command (%s): %w", cc.Name, err)
+	}
+
+	name := strings.ToLower(cc.Name)
+	response := cc.Response
+
+	return Command{
+		Name:         cc.Name,
+		Aliases:      cc.Aliases,
+		Description:  "Custom command",
+		Permission:   permission,
+		Cooldown:     time.Duration(cc.Cooldown),
+		UserCooldown: time.Duration(cc.UserCooldown),
+		Handler: func(ctx *CommandContext) error {
+			return ctx.Reply(c.expand(response, name, ctx))
+		},
+	}, nil
+}
+
+// expand fills in the variables of a response
+func (c *CustomCommands) expand(response string, name string, ctx *CommandContext) string {
+	var counter int64
+	var info StreamInfo
+
+	if strings.Contains(response, "{counter}") {
+		counter = c.count(name)
+	}
+
+	for _, v := range []string{"{uptime}", "{title}", "{viewers}", "{followers}"} {
+		if strings.Contains(response, v) {
+			info = c.streamInfo()
+			break
+		}
+	}
+
+	sender := ctx.Message.Sender.Displayname
+
+	if sender == "" {
+		sender = ctx.Message.Sender.Username
+	}
+
+	return variablePattern.ReplaceAllStringFunc(response, func(v string) string {
+		key := v[1 : len(v)-1]
+
+		switch key {
+		case "sender":
+			return sender
+		case "target":
+			if t := strings.TrimPrefix(ctx.Arg(0), "@"); t != "" {
+				return t
+			}
+			return sender
+		case "args":
+			return ctx.RawArgs()
+		case "counter":
+			return strconv.FormatInt(counter, 10)
+		case "streamer":
+			return c.Streamer
+		case "uptime":
+			if !info.Live {
+				return "offline"
+			}
+			return formatDuration(info.Uptime(c.now()))
+		case "title":
+			return info.Title
+		case "viewers":
+			return strconv.FormatInt(info.Viewers, 10)
+		case "followers":
+			return strconv.FormatInt(info.Followers, 10)
+		}
+
+		if strings.HasPrefix(key, "arg") {
+			if i, err := strconv.Atoi(key[3:]); err == nil && i > 0 {
+				return ctx.Arg(i - 1)
+			}
+		}
+
+		return v
+	})
+}
+
+// count increments and gives the command's counter, leaving it for Run to save
+func (c *CustomCommands) count(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counters == nil {
+		c.counters = make(map[string]int64)
+	}
+
+	c.counters[name]++
+	c.dirty = true
+
+	return c.counters[name]
+}
+
+// loadCounters reads the counter file if there is one, the lock must be held
+func (c *CustomCommands) loadCounters() error {
+	if c.CounterPath == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(c.CounterPath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if c.counters == nil {
+		c.counters = make(map[string]int64)
+	}
+
+	return json.Unmarshal(b, &c.counters)
+}
+
+// streamInfo gives the streamer's channel info, looking it up again once it is too old
+func (c *CustomCommands) streamInfo() StreamInfo {
+	if c.Info == nil {
+		return StreamInfo{}
+	}
+
+	maxAge := c.InfoMaxAge
+
+	if maxAge <= 0 {
+		maxAge = DefaultStreamInfoMaxAge
+	}
+
+	c.mu.Lock()
+
+	if !c.infoAt.IsZero() && c.now().Sub(c.infoAt) < maxAge {
+		info := c.info
+		c.mu.Unlock()
+		return info
+	}
+
+	c.mu.Unlock()
+
+	info, err := FetchStreamInfo(c.Info, c.Streamer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		logger(c.Logger).Warn("unable to look up stream info", "streamer", c.Streamer, "error", err)
+		return c.info
+	}
+
+	c.info = info
+	c.infoAt = c.now()
+
+	return info
+}
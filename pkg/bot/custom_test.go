@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// fakeStreamInfo serves a fixed LivestreamPage response
+type fakeStreamInfo struct {
+	calls   int
+	offline bool
+}
+
+func (f *fakeStreamInfo) LivestreamPage(args api.LivestreamPageArgs) (api.Response, error) {
+	f.calls++
+
+	if f.offline {
+		return api.Response{Data: map[string]interface{}{
+			"userByDisplayName": map[string]interface{}{"livestream": nil},
+		}}, nil
+	}
+
+	return api.Response{Data: map[string]interface{}{
+		"userByDisplayName": map[string]interface{}{
+			"followers": map[string]interface{}{"totalCount": float64(42)},
+			"livestream": map[string]interface{}{
+				"title":     "Speedruns",
+				"createdAt": "1577833200000", // 2019-12-31 23:00 UTC, an hour before the fake clock
+			},
+		},
+	}}, nil
+}
+
+func TestCustomCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "commands.json")
+	sender := &fakeSender{}
+	clock := newFakeClock()
+	info := &fakeStreamInfo{}
+
+	r := newTestRouter(sender, clock)
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write commands: %s", err)
+		}
+	}
+
+	write(`{"commands": [
+		{"name": "hug", "response": "{sender} hugs {target} ({counter})", "userCooldown": "10s"},
+		{"name": "live", "aliases": ["uptime"], "response": "{title} has been live {uptime} for {followers} followers"}
+	]}`)
+
+	c := NewCustomCommands(path, r)
+	c.Info = info
+	c.Streamer = "streamer"
+	c.CounterPath = filepath.Join(dir, "counters.json")
+	c.now = clock.Now
+
+	if err := c.Load(); err != nil {
+		t.Fatalf("failed to load commands: %s", err)
+	}
+
+	r.HandleMessage(chatMessage("1", "alice", "!hug @bob"))
+	r.HandleMessage(chatMessage("2", "carol", "!hug"))
+	r.HandleMessage(chatMessage("2", "carol", "!uptime"))
+	r.HandleMessage(chatMessage("3", "dave", "!live"))
+
+	want := []string{
+		"alice hugs bob (1)",
+		"carol hugs carol (2)",
+		"Speedruns has been live 1h 0m for 42 followers",
+		"Speedruns has been live 1h 0m for 42 followers",
+	}
+
+	if !reflect.DeepEqual(sender.messages(), want) {
+		t.Errorf("expected replies %q, got %q", want, sender.messages())
+	}
+
+	if info.calls != 1 {
+		t.Errorf("expected stream info to be looked up once, was looked up %d times", info.calls)
+	}
+
+	// A broken file keeps the last good commands
+	write(`{"commands": [{"name": "hug"}]}`)
+
+	if err := c.Load(); err == nil {
+		t.Error("expected command without a response to be refused")
+	}
+
+	// A clash with another command keeps the last good commands
+	write(`{"commands": [{"name": "wave", "response": "hi"}, {"name": "hug", "aliases": ["echo"], "response": "x"}]}`)
+	_ = r.Handle(Command{Name: "echo", Handler: func(*CommandContext) error { return nil }})
+
+	if err := c.Load(); err == nil {
+		t.Error("expected clashing command to be refused")
+	}
+
+	if !r.HandleMessage(chatMessage("1", "alice", "!live")) || r.HandleMessage(chatMessage("1", "alice", "!wave")) {
+		t.Error("expected the last good commands to be kept")
+	}
+
+	write(`{"commands": [{"name": "hug", "response": "{sender} hugs everyone ({counter})"}]}`)
+
+	if err := c.Load(); err != nil {
+		t.Fatalf("failed to reload commands: %s", err)
+	}
+
+	if r.HandleMessage(chatMessage("1", "alice", "!live")) {
+		t.Error("expected removed command to be gone")
+	}
+
+	if _, err := os.Stat(c.CounterPath); !os.IsNotExist(err) {
+		t.Errorf("expected counters to wait to be flushed, got %v", err)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("failed to save counters: %s", err)
+	}
+
+	// Counters survive a restart
+	restarted := NewCustomCommands(path, NewRouter(Chat{Sender: sender}))
+	restarted.CounterPath = c.CounterPath
+
+	if err := restarted.Load(); err != nil {
+		t.Fatalf("failed to load commands after restart: %s", err)
+	}
+
+	if n := restarted.Counter("hug"); n != 2 {
+		t.Errorf("expected hug counter to be 2 after restart, got %d", n)
+	}
+}
@@ -0,0 +1,170 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultMessageStoreLimit is how many chat messages a MessageStore keeps, if its limit is 0
+const DefaultMessageStoreLimit = 5000
+
+// DefaultDeletionLimit is how many deleted messages a MessageStore keeps for review
+const DefaultDeletionLimit = 200
+
+// DeletedMessage is a chat message that was deleted, with what it said and who sent it
+type DeletedMessage struct {
+	Message   api.StreamMessage // The deleted chat message
+	SentAt    time.Time         // When the message was seen
+	DeletedAt time.Time         // When the delete event was seen
+}
+
+// storedMessage is a chat message kept by a MessageStore
+type storedMessage struct {
+	message api.StreamMessage
+	at      time.Time
+	seq     uint64 // When it was stored, matching its place in the store's order
+}
+
+// storedID is a place in a MessageStore's order
+type storedID struct {
+	id  string
+	seq uint64
+}
+
+// MessageStore keeps the most recent chat messages by ID, so deleted ones can be seen for review
+// Delete events only carry the IDs of the messages removed, messages deleted after they fell out of the store can't be resolved
+// Deleted messages are remembered by ID, so a replayed history can't store them again or resolve them twice
+type MessageStore struct {
+	OnDelete func(d DeletedMessage) // Called with each deleted message that was resolved, if set
+
+	mu        sync.Mutex
+	limit     int
+	messages  map[string]storedMessage
+	order     []storedID // Message IDs, oldest first
+	seq       uint64
+	resolved  *recentIDs // IDs of messages resolved as deleted
+	deletions []DeletedMessage
+	now       func() time.Time
+}
+
+// NewMessageStore creates a MessageStore keeping up to limit messages, DefaultMessageStoreLimit if 0
+func NewMessageStore(limit int) *MessageStore {
+	if limit <= 0 {
+		limit = DefaultMessageStoreLimit
+	}
+
+	return &MessageStore{
+		limit:    limit,
+		messages: make(map[string]storedMessage),
+		resolved: newRecentIDs(limit),
+		now:      time.Now,
+	}
+}
+
+// HandleMessage stores chat messages, and resolves delete events to the messages they removed
+func (s *MessageStore) HandleMessage(m api.StreamMessage) {
+	switch m.Type {
+	case api.MessageTypeText:
+		s.store(m)
+	case api.MessageTypeDelete:
+		for _, d := range s.Resolve(m.IDs) {
+			if s.OnDelete != nil {
+				s.OnDelete(d)
+			}
+		}
+	}
+}
+
+// Message gives the stored chat message with the given ID
+func (s *MessageStore) Message(id string) (api.StreamMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.messages[id]
+
+	return stored.message, ok
+}
+
+// Resolve takes the messages with the given IDs out of the store as deleted messages, skipping IDs it doesn't have
+func (s *MessageStore) Resolve(ids []string) []DeletedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resolved []DeletedMessage
+
+	now := s.now()
+
+	for _, id := range ids {
+		stored, ok := s.messages[id]
+
+		if !ok || !s.resolved.add(id) {
+			continue
+		}
+
+		delete(s.messages, id)
+
+		d := DeletedMessage{
+			Message:   stored.message,
+			SentAt:    stored.at,
+			DeletedAt: now,
+		}
+
+		resolved = append(resolved, d)
+		s.deletions = append(s.deletions, d)
+	}
+
+	if extra := len(s.deletions) - DefaultDeletionLimit; extra > 0 {
+		s.deletions = append([]DeletedMessage(nil), s.deletions[extra:]...)
+	}
+
+	return resolved
+}
+
+// Deletions gives the most recently resolved deleted messages, oldest first
+func (s *MessageStore) Deletions() []DeletedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]DeletedMessage(nil), s.deletions...)
+}
+
+// Len gives how many chat messages are stored
+func (s *MessageStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.messages)
+}
+
+func (s *MessageStore) store(m api.StreamMessage) {
+	if m.ID == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Already stored, or deleted and being replayed
+	if _, ok := s.messages[m.ID]; ok || s.resolved.has(m.ID) {
+		return
+	}
+
+	s.seq++
+	s.messages[m.ID] = storedMessage{message: m, at: s.now(), seq: s.seq}
+	s.order = append(s.order, storedID{id: m.ID, seq: s.seq})
+
+	// Deleted messages leave their IDs in order, so trim by order rather than by what is stored
+	// A message stored again once its deletion was forgotten has a newer place, which its old one mustn't remove
+	for len(s.order) > s.limit {
+		oldest := s.order[0]
+
+		if stored, ok := s.messages[oldest.id]; ok && stored.seq == oldest.seq {
+			delete(s.messages, oldest.id)
+		}
+
+		s.order[0] = storedID{}
+		s.order = s.order[1:]
+	}
+}
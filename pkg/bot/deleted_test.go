@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestMessageStore(t *testing.T) {
+	clock := newFakeClock()
+
+	s := NewMessageStore(3)
+	s.now = clock.Now
+
+	var deleted []DeletedMessage
+
+	s.OnDelete = func(d DeletedMessage) {
+		deleted = append(deleted, d)
+	}
+
+	message := func(id string, content string) api.StreamMessage {
+		m := chatMessage("1", "alice", content)
+		m.ID = id
+
+		return m
+	}
+
+	s.HandleMessage(message("a", "first"))
+	s.HandleMessage(message("b", "second"))
+	clock.Advance(time.Minute)
+
+	remove := api.StreamMessage{Type: api.MessageTypeDelete, IDs: []string{"b", "unknown"}}
+
+	s.HandleMessage(remove)
+	s.HandleMessage(remove) // Replayed
+
+	if len(deleted) != 1 || deleted[0].Message.Content != "second" || deleted[0].DeletedAt.Sub(deleted[0].SentAt) != time.Minute {
+		t.Fatalf("expected the second message resolved once, got %+v", deleted)
+	}
+
+	if _, ok := s.Message("b"); ok {
+		t.Error("expected the deleted message taken out of the store")
+	}
+
+	// The feed replaying its history, deleted message and delete event included
+	s.HandleMessage(message("b", "second"))
+	s.HandleMessage(remove)
+
+	if _, ok := s.Message("b"); ok || len(deleted) != 1 || len(s.Deletions()) != 1 {
+		t.Errorf("expected a replayed deleted message not stored or resolved again, got %+v", s.Deletions())
+	}
+
+	s.HandleMessage(message("c", "third"))
+	s.HandleMessage(message("d", "fourth"))
+	s.HandleMessage(message("e", "fifth"))
+
+	// The store is full, so the oldest places are trimmed
+	if _, ok := s.Message("a"); ok {
+		t.Error("expected the oldest message trimmed")
+	}
+
+	for _, id := range []string{"c", "d", "e"} {
+		if _, ok := s.Message(id); !ok {
+			t.Errorf("expected message %s kept", id)
+		}
+	}
+
+	if s.Len() != 3 {
+		t.Errorf("expected 3 messages, got %d", s.Len())
+	}
+}
@@ -0,0 +1,484 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// Errors given by a Giveaway used in the wrong state
+var (
+	ErrGiveawayOpen = errors.New("a giveaway is already open")
+	ErrNoGiveaway   = errors.New("no giveaway is open")
+	ErrNoEntries    = errors.New("the giveaway has no entries")
+	ErrDrawMismatch = errors.New("the seed and entries do not give the recorded winners")
+	ErrSeedMismatch = errors.New("the seed does not match the committed seed hash")
+	errNoKeyword    = errors.New("a giveaway needs a keyword")
+)
+
+// Eligibility is who may enter a giveaway
+type Eligibility int
+
+const (
+	EligibleEveryone    Eligibility = iota // Anyone in chat
+	EligibleFollowers                      // Followers and subscribers of the streamer
+	EligibleSubscribers                    // Subscribers of the streamer
+)
+
+func (e Eligibility) String() string {
+	switch e {
+	case EligibleEveryone:
+		return "everyone"
+	case EligibleFollowers:
+		return "followers"
+	case EligibleSubscribers:
+		return "subscribers"
+	default:
+		return fmt.Sprintf("eligibility(%d)", int(e))
+	}
+}
+
+// FollowerChecker reports if a chatter follows the streamer
+type FollowerChecker interface {
+	IsFollower(m api.StreamMessage) (bool, error)
+}
+
+// FollowerSet is a FollowerChecker that knows the followers it has been given, and ones seen following in chat
+type FollowerSet struct {
+	mu        sync.Mutex
+	usernames map[string]bool
+}
+
+// NewFollowerSet creates a FollowerSet holding the given usernames
+func NewFollowerSet(usernames ...string) *FollowerSet {
+	s := &FollowerSet{usernames: make(map[string]bool)}
+
+	for _, u := range usernames {
+		s.usernames[strings.ToLower(u)] = true
+	}
+
+	return s
+}
+
+// HandleMessage adds chatters who follow the streamer while the set is in use
+func (s *FollowerSet) HandleMessage(m api.StreamMessage) {
+	if m.Type != api.MessageTypeFollow {
+		return
+	}
+
+	s.mu.Lock()
+	s.usernames[strings.ToLower(m.Sender.Username)] = true
+	s.mu.Unlock()
+}
+
+func (s *FollowerSet) IsFollower(m api.StreamMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usernames[strings.ToLower(m.Sender.Username)], nil
+}
+
+// Entry is a chatter taking part in a giveaway
+type Entry struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	Weight   int64  `json:"weight"` // How many chances the chatter has to win
+}
+
+// Draw is the record of a giveaway, enough to check its winners were drawn fairly using VerifyDraw
+type Draw struct {
+	ID          string      `json:"id"`
+	Keyword     string      `json:"keyword"`
+	Eligibility string      `json:"eligibility"`
+	SeedHash    string      `json:"seedHash"`       // SHA-256 of the seed, announced when the giveaway opened
+	Seed        string      `json:"seed,omitempty"` // The random seed in hex, revealed once winners are drawn
+	Entries     []Entry     `json:"entries"`        // Every entry, ordered by user ID
+	Winners     []Entry     `json:"winners"`
+	OpenedAt    time.Time   `json:"openedAt"`
+	DrawnAt     time.Time   `json:"drawnAt"`
+	Cancelled   bool        `json:"cancelled,omitempty"`
+	eligibility Eligibility // Who may enter, as given to Open
+}
+
+// giveawayAuditRecord is a line in a giveaway audit file
+type giveawayAuditRecord struct {
+	Event string    `json:"event"` // open, draw, or cancel
+	At    time.Time `json:"at"`
+	Draw  Draw      `json:"draw"`
+}
+
+// Giveaway runs chat giveaways, where chatters enter by sending a keyword and winners are drawn at random
+// The random seed is committed to by announcing its hash when the giveaway opens, and revealed with the winners, so anyone can check the draw with VerifyDraw
+type Giveaway struct {
+	Chat        Chat
+	Followers   FollowerChecker // Used for follower only giveaways, which can't be opened without it
+	MonthWeight int64           // Extra chances a subscriber gets for each month subscribed, see HandleMessage
+	AuditPath   string          // JSON lines file every giveaway is recorded to, nothing is recorded if empty
+	Logger      api.Logger      // Where audit failures are reported, silent if nil
+
+	mu      sync.Mutex
+	current *Draw
+	seed    []byte
+	entered map[string]bool
+	months  map[string]int64 // Subscription months from subscription events seen, by user ID
+	now     func() time.Time
+}
+
+// NewGiveaway creates a Giveaway announced in the given chat
+func NewGiveaway(chat Chat) *Giveaway {
+	return &Giveaway{
+		Chat:   chat,
+		months: make(map[string]int64),
+		now:    time.Now,
+	}
+}
+
+// Open starts a giveaway entered by sending the keyword in chat, announcing the hash of its random seed
+func (g *Giveaway) Open(keyword string, eligibility Eligibility) (Draw, error) {
+	keyword = strings.TrimSpace(keyword)
+
+	if keyword == "" {
+		return Draw{}, errNoKeyword
+	}
+
+	if eligibility == EligibleFollowers && g.Followers == nil {
+		return Draw{}, errors.New("follower only giveaways need a FollowerChecker")
+	}
+
+	seed := make([]byte, 32)
+
+	if _, err := rand.Read(seed); err != nil {
+		return Draw{}, err
+	}
+
+	g.mu.Lock()
+
+	if g.current != nil {
+		g.mu.Unlock()
+		return Draw{}, ErrGiveawayOpen
+	}
+
+	hash := sha256.Sum256(seed)
+	now := g.now()
+
+	d := &Draw{
+		ID:          strconv.FormatInt(now.UnixNano(), 36),
+		Keyword:     keyword,
+		Eligibility: eligibility.String(),
+		SeedHash:    hex.EncodeToString(hash[:]),
+		OpenedAt:    now,
+		eligibility: eligibility,
+	}
+
+	g.current = d
+	g.seed = seed
+	g.entered = make(map[string]bool)
+
+	record := *d
+	g.mu.Unlock()
+
+	g.audit("open", record)
+
+	err := g.Chat.Say(fmt.Sprintf("Giveaway open to %s! Type %s to enter. Seed hash: %s", eligibility, keyword, record.SeedHash))
+
+	return record, err
+}
+
+// HandleMessage enters chatters who send the keyword, and remembers subscription months for weighting entries
+// Chat messages only say if the sender is subscribed, so months are only known for subscription events seen since the Giveaway was created
+// Subscribers who haven't renewed in that time count as subscribed for 1 month
+func (g *Giveaway) HandleMessage(m api.StreamMessage) {
+	switch m.Type {
+	case api.MessageTypeSubscription:
+		g.mu.Lock()
+		if g.months == nil {
+			g.months = make(map[string]int64)
+		}
+		g.months[m.Sender.ID] = m.Months()
+		g.mu.Unlock()
+	case api.MessageTypeText:
+		g.enter(m)
+	}
+}
+
+// Draw closes entry to the giveaway and picks up to n winners, announcing them and revealing the seed
+func (g *Giveaway) Draw(n int) (Draw, error) {
+	g.mu.Lock()
+
+	d := g.current
+
+	if d == nil {
+		g.mu.Unlock()
+		return Draw{}, ErrNoGiveaway
+	}
+
+	if len(d.Entries) == 0 {
+		g.mu.Unlock()
+		return Draw{}, ErrNoEntries
+	}
+
+	sort.Slice(d.Entries, func(i, j int) bool {
+		return d.Entries[i].UserID < d.Entries[j].UserID
+	})
+
+	d.Seed = hex.EncodeToString(g.seed)
+	d.Winners = drawWinners(g.seed, d.Entries, n)
+	d.DrawnAt = g.now()
+
+	record := *d
+	g.current = nil
+	g.mu.Unlock()
+
+	g.audit("draw", record)
+
+	names := make([]string, len(record.Winners))
+
+	for i, w := range record.Winners {
+		names[i] = "@" + w.Username
+	}
+
+	err := g.Chat.Say(fmt.Sprintf("Congratulations %s! (%d entries, seed %s)", strings.Join(names, ", "), len(record.Entries), record.Seed))
+
+	return record, err
+}
+
+// Cancel closes the giveaway without drawing winners
+func (g *Giveaway) Cancel() error {
+	g.mu.Lock()
+
+	d := g.current
+
+	if d == nil {
+		g.mu.Unlock()
+		return ErrNoGiveaway
+	}
+
+	d.Cancelled = true
+	d.Seed = hex.EncodeToString(g.seed)
+
+	record := *d
+	g.current = nil
+	g.mu.Unlock()
+
+	g.audit("cancel", record)
+
+	return g.Chat.Say("The giveaway was cancelled")
+}
+
+// Register adds !giveaway open <keyword> [followers|subscribers], !giveaway draw [winners], and !giveaway cancel to the router for moderators
+func (g *Giveaway) Register(r *Router) error {
+	return r.Handle(Command{
+		Name:        "giveaway",
+		Description: "Runs a giveaway",
+		Permission:  PermissionModerator,
+		Handler:     g.command,
+	})
+}
+
+func (g *Giveaway) command(c *CommandContext) error {
+	var err error
+
+	switch strings.ToLower(c.Arg(0)) {
+	case "open":
+		eligibility := EligibleEveryone
+
+		switch strings.ToLower(c.Arg(2)) {
+		case "followers":
+			eligibility = EligibleFollowers
+		case "subscribers", "subs":
+			eligibility = EligibleSubscribers
+		}
+
+		_, err = g.Open(c.Arg(1), eligibility)
+	case "draw":
+		n := 1
+
+		if c.Arg(1) != "" {
+			if n, err = strconv.Atoi(c.Arg(1)); err != nil || n < 1 {
+				return c.Reply("Usage: giveaway draw [winners]")
+			}
+		}
+
+		_, err = g.Draw(n)
+	case "cancel":
+		err = g.Cancel()
+	default:
+		return c.Reply("Usage: giveaway open <keyword> [followers|subscribers], giveaway draw [winners], giveaway cancel")
+	}
+
+	switch err {
+	case ErrGiveawayOpen, ErrNoGiveaway, ErrNoEntries, errNoKeyword:
+		return c.Reply(err.Error())
+	}
+
+	return err
+}
+
+// enter adds the sender to the giveaway if the message is the keyword and they are eligible
+func (g *Giveaway) enter(m api.StreamMessage) {
+	g.mu.Lock()
+	d := g.current
+
+	if d == nil || g.entered[m.Sender.ID] || !strings.EqualFold(strings.TrimSpace(m.Content), d.Keyword) {
+		g.mu.Unlock()
+		return
+	}
+
+	eligibility := d.eligibility
+	months := g.months[m.Sender.ID]
+	g.mu.Unlock()
+
+	if !g.eligible(m, eligibility) {
+		return
+	}
+
+	weight := int64(1)
+
+	if m.Subscribing {
+		if months < 1 {
+			months = 1
+		}
+
+		weight += months * g.MonthWeight
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// The giveaway may have closed, or the chatter entered, while eligibility was checked
+	if g.current != d || g.entered[m.Sender.ID] {
+		return
+	}
+
+	g.entered[m.Sender.ID] = true
+	d.Entries = append(d.Entries, Entry{UserID: m.Sender.ID, Username: m.Sender.Username, Weight: weight})
+}
+
+func (g *Giveaway) eligible(m api.StreamMessage, eligibility Eligibility) bool {
+	switch eligibility {
+	case EligibleSubscribers:
+		return m.Subscribing
+	case EligibleFollowers:
+		if m.Subscribing {
+			return true
+		}
+
+		ok, err := g.Followers.IsFollower(m)
+
+		if err != nil {
+			logger(g.Logger).Warn("unable to check follower", "user", m.Sender.Username, "error", err)
+		}
+
+		return ok
+	}
+
+	return true
+}
+
+func (g *Giveaway) audit(event string, d Draw) {
+	if g.AuditPath == "" {
+		return
+	}
+
+	err := appendJSONLine(g.AuditPath, giveawayAuditRecord{Event: event, At: g.now(), Draw: d})
+
+	if err != nil {
+		logger(g.Logger).Error("unable to record giveaway", "giveaway", d.ID, "event", event, "error", err)
+	}
+}
+
+// VerifyDraw checks a giveaway's winners were drawn from its entries using the committed seed
+func VerifyDraw(d Draw) error {
+	seed, err := hex.DecodeString(d.Seed)
+
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(seed)
+
+	if hex.EncodeToString(hash[:]) != d.SeedHash {
+		return ErrSeedMismatch
+	}
+
+	winners := drawWinners(seed, d.Entries, len(d.Winners))
+
+	if len(winners) != len(d.Winners) {
+		return ErrDrawMismatch
+	}
+
+	for i := range winners {
+		if winners[i] != d.Winners[i] {
+			return ErrDrawMismatch
+		}
+	}
+
+	return nil
+}
+
+// drawWinners picks up to n entries without replacement, each entry's chance being its share of the remaining weight
+// Random numbers come from HMAC-SHA256 of a counter keyed by the seed, so the same seed and entries always give the same winners
+func drawWinners(seed []byte, entries []Entry, n int) []Entry {
+	remaining := append([]Entry(nil), entries...)
+
+	var winners []Entry
+	var counter uint64
+
+	for len(winners) < n && len(remaining) > 0 {
+		var total int64
+
+		for _, e := range remaining {
+			total += e.Weight
+		}
+
+		if total <= 0 {
+			break
+		}
+
+		r := int64(seededUint64(seed, &counter, uint64(total)))
+
+		for i, e := range remaining {
+			if r < e.Weight {
+				winners = append(winners, e)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+
+			r -= e.Weight
+		}
+	}
+
+	return winners
+}
+
+// seededUint64 gives a uniform number below max, advancing the counter for every block of randomness used
+func seededUint64(seed []byte, counter *uint64, max uint64) uint64 {
+	// Reject values from the incomplete range at the top, so every result is equally likely
+	limit := ^uint64(0) - (^uint64(0) % max)
+
+	for {
+		mac := hmac.New(sha256.New, seed)
+
+		var block [8]byte
+		binary.BigEndian.PutUint64(block[:], *counter)
+		mac.Write(block[:])
+		*counter++
+
+		v := binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+
+		if v < limit {
+			return v % max
+		}
+	}
+}
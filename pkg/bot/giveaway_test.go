@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestGiveaway(t *testing.T) {
+	audit := filepath.Join(t.TempDir(), "giveaways.jsonl")
+	sender := &fakeSender{}
+
+	g := NewGiveaway(Chat{Sender: sender})
+	g.AuditPath = audit
+	g.MonthWeight = 2
+
+	if _, err := g.Open("!enter", EligibleFollowers); err == nil {
+		t.Error("expected follower only giveaway without a FollowerChecker to be refused")
+	}
+
+	g.Followers = NewFollowerSet("alice")
+
+	opened, err := g.Open("!enter", EligibleFollowers)
+
+	if err != nil {
+		t.Fatalf("failed to open giveaway: %s", err)
+	}
+
+	if _, err := g.Open("!again", EligibleEveryone); err != ErrGiveawayOpen {
+		t.Errorf("expected second giveaway to be refused, got %v", err)
+	}
+
+	sub := chatMessage("3", "carol", "!ENTER")
+	sub.Subscribing = true
+
+	g.HandleMessage(api.StreamMessage{Type: api.MessageTypeSubscription, Month: "3", Sender: api.Sender{ID: "3"}})
+	g.HandleMessage(chatMessage("1", "alice", "!enter"))
+	g.HandleMessage(chatMessage("1", "alice", "!enter"))
+	g.HandleMessage(chatMessage("2", "bob", "!enter")) // Not a follower
+	g.HandleMessage(sub)
+
+	d, err := g.Draw(5)
+
+	if err != nil {
+		t.Fatalf("failed to draw: %s", err)
+	}
+
+	if d.SeedHash != opened.SeedHash || len(d.Entries) != 2 || len(d.Winners) != 2 {
+		t.Fatalf("expected 2 entries and winners under the opened seed hash, got %+v", d)
+	}
+
+	if d.Entries[1].Weight != 7 {
+		t.Errorf("expected subscriber to have 7 chances, has %d", d.Entries[1].Weight)
+	}
+
+	if err := VerifyDraw(d); err != nil {
+		t.Errorf("expected draw to verify, got %s", err)
+	}
+
+	d.Winners[0], d.Winners[1] = d.Winners[1], d.Winners[0]
+
+	if err := VerifyDraw(d); err != ErrDrawMismatch {
+		t.Errorf("expected tampered draw to fail verification, got %v", err)
+	}
+
+	f, err := os.Open(audit)
+
+	if err != nil {
+		t.Fatalf("failed to open audit file: %s", err)
+	}
+
+	defer f.Close()
+
+	var events []string
+
+	for s := bufio.NewScanner(f); s.Scan(); {
+		events = append(events, s.Text()[:strings.Index(s.Text(), `","at"`)])
+	}
+
+	if len(events) != 2 || events[0] != `{"event":"open` || events[1] != `{"event":"draw` {
+		t.Errorf("expected open and draw to be audited, got %q", events)
+	}
+}
+
+func TestGiveaway_UnseenMonths(t *testing.T) {
+	g := NewGiveaway(Chat{Sender: &fakeSender{}})
+	g.MonthWeight = 2
+
+	if _, err := g.Open("!enter", EligibleEveryone); err != nil {
+		t.Fatalf("failed to open giveaway: %s", err)
+	}
+
+	// No subscription event was seen, so the months subscribed aren't known
+	sub := chatMessage("1", "alice", "!enter")
+	sub.Subscribing = true
+
+	g.HandleMessage(sub)
+
+	d, err := g.Draw(1)
+
+	if err != nil {
+		t.Fatalf("failed to draw: %s", err)
+	}
+
+	if len(d.Entries) != 1 || d.Entries[0].Weight != 3 {
+		t.Errorf("expected the subscriber counted for 1 month with 3 chances, got %+v", d.Entries)
+	}
+}
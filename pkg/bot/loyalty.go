@@ -0,0 +1,259 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// leaderboardSize is how many viewers the leaderboard command lists
+const leaderboardSize = 5
+
+// Ledger awards loyalty points to viewers for chatting, watching, gifting, and subscribing
+// Each chat event is counted once by its ID, so history replays and reconnects don't award points twice
+type Ledger struct {
+	Store PointsStore
+	Self  string // The bot account's username, it never earns points
+
+	ChatPoints         int64         // Points for a chat message
+	ChatCooldown       time.Duration // Least amount of time between a viewer earning chat points
+	PresencePoints     int64         // Points given by AwardPresence to every viewer who chatted recently
+	PresenceWindow     time.Duration // How recently a viewer must have chatted to count as watching
+	GiftPoints         int64         // Points for every lemon a gift is worth
+	SubscriptionPoints int64         // Points for every month of a subscription
+
+	Logger api.Logger // Where store errors are reported, silent if nil
+
+	mu       sync.Mutex
+	lastChat map[string]time.Time // When each viewer last earned chat points, by user ID
+	present  map[string]presence  // Viewers who chatted recently, by user ID
+	now      func() time.Time
+}
+
+// presence is when a viewer was last seen in chat
+type presence struct {
+	username string
+	at       time.Time
+}
+
+// NewLedger creates a Ledger that keeps balances in the store
+func NewLedger(store PointsStore) *Ledger {
+	return &Ledger{
+		Store:    store,
+		lastChat: make(map[string]time.Time),
+		present:  make(map[string]presence),
+		now:      time.Now,
+	}
+}
+
+// HandleMessage awards points for a chat event
+func (l *Ledger) HandleMessage(m api.StreamMessage) {
+	if m.Sender.ID == "" || sameUser(m, l.Self) {
+		return
+	}
+
+	switch m.Type {
+	case api.MessageTypeText:
+		if l.chatted(m) {
+			l.award(m, l.ChatPoints, m.ID)
+		}
+	case api.MessageTypeGift:
+		l.award(m, m.Lemons()*l.GiftPoints, m.ID)
+	case api.MessageTypeSubscription:
+		l.award(m, m.Months()*l.SubscriptionPoints, m.ID)
+	}
+}
+
+// AwardPresence gives presence points to every viewer who chatted within the presence window
+// Viewers who are no longer present or whose chat cooldown is over are forgotten
+func (l *Ledger) AwardPresence() {
+	now := l.now()
+
+	l.mu.Lock()
+
+	var viewers []api.StreamMessage
+
+	for id, p := range l.present {
+		if now.Sub(p.at) >= l.PresenceWindow {
+			delete(l.present, id)
+			continue
+		}
+
+		viewers = append(viewers, api.StreamMessage{Sender: api.Sender{ID: id, Username: p.username}})
+	}
+
+	for id, last := range l.lastChat {
+		if now.Sub(last) >= l.ChatCooldown {
+			delete(l.lastChat, id)
+		}
+	}
+
+	l.mu.Unlock()
+
+	for _, v := range viewers {
+		l.award(v, l.PresencePoints, "")
+	}
+}
+
+// Run calls AwardPresence every interval until the context is done
+func (l *Ledger) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			l.AwardPresence()
+		}
+	}
+}
+
+// Register adds the ledger's commands to the router
+// Everyone can use !points and !top, moderators can use !give <user> <amount> and !take <user> <amount>
+func (l *Ledger) Register(r *Router) error {
+	commands := []Command{
+		{
+			Name:         "points",
+			Aliases:      []string{"balance"},
+			Description:  "Shows your loyalty points",
+			UserCooldown: 30 * time.Second,
+			Handler:      l.balanceCommand,
+		},
+		{
+			Name:        "top",
+			Aliases:     []string{"leaderboard"},
+			Description: "Shows the viewers with the most loyalty points",
+			Cooldown:    30 * time.Second,
+			Handler:     l.leaderboardCommand,
+		},
+		{
+			Name:        "give",
+			Description: "Gives a viewer loyalty points",
+			Permission:  PermissionModerator,
+			Handler:     l.adjustCommand(1),
+		},
+		{
+			Name:        "take",
+			Description: "Takes loyalty points from a viewer",
+			Permission:  PermissionModerator,
+			Handler:     l.adjustCommand(-1),
+		},
+	}
+
+	for _, c := range commands {
+		if err := r.Handle(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chatted records a chat message, reporting if the sender is off their chat points cooldown
+func (l *Ledger) chatted(m api.StreamMessage) bool {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.present == nil {
+		l.present = make(map[string]presence)
+		l.lastChat = make(map[string]time.Time)
+	}
+
+	l.present[m.Sender.ID] = presence{username: m.Sender.Username, at: now}
+
+	if last, ok := l.lastChat[m.Sender.ID]; ok && now.Sub(last) < l.ChatCooldown {
+		return false
+	}
+
+	if l.ChatCooldown > 0 {
+		l.lastChat[m.Sender.ID] = now
+	}
+
+	return true
+}
+
+func (l *Ledger) award(m api.StreamMessage, points int64, eventID string) {
+	if points <= 0 {
+		return
+	}
+
+	if eventID != "" {
+		eventID = m.Type + ":" + eventID
+	}
+
+	if _, _, err := l.Store.Apply(m.Sender.ID, m.Sender.Username, points, eventID); err != nil {
+		logger(l.Logger).Error("unable to award points", "user", m.Sender.Username, "points", points, "error", err)
+	}
+}
+
+func (l *Ledger) balanceCommand(c *CommandContext) error {
+	a, _, err := l.Store.Account(c.Message.Sender.ID)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Reply(fmt.Sprintf("@%s you have %d points", c.Message.Sender.Username, a.Points))
+}
+
+func (l *Ledger) leaderboardCommand(c *CommandContext) error {
+	top, err := l.Store.Top(leaderboardSize)
+
+	if err != nil {
+		return err
+	}
+
+	if len(top) == 0 {
+		return c.Reply("Nobody has any points yet")
+	}
+
+	entries := make([]string, len(top))
+
+	for i, a := range top {
+		entries[i] = fmt.Sprintf("%d. %s (%d)", i+1, a.Username, a.Points)
+	}
+
+	return c.Reply("Top viewers: " + strings.Join(entries, ", "))
+}
+
+// adjustCommand handles !give and !take, sign is 1 to give and -1 to take
+func (l *Ledger) adjustCommand(sign int64) CommandFunc {
+	return func(c *CommandContext) error {
+		amount, err := strconv.ParseInt(c.Arg(1), 10, 64)
+
+		if err != nil || amount <= 0 {
+			return c.Reply(fmt.Sprintf("Usage: %s <user> <amount>", c.Name))
+		}
+
+		a, ok, err := l.Store.Lookup(c.Arg(0))
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return c.Reply(fmt.Sprintf("%s has no points yet", c.Arg(0)))
+		}
+
+		a, _, err = l.Store.Apply(a.UserID, "", sign*amount, "")
+
+		if err == ErrInsufficientPoints {
+			return c.Reply(fmt.Sprintf("%s only has %d points", a.Username, a.Points))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return c.Reply(fmt.Sprintf("%s now has %d points", a.Username, a.Points))
+	}
+}
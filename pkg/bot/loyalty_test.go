@@ -0,0 +1,113 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.json")
+	store, err := NewLocalPointsStore(path)
+
+	if err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+
+	clock := newFakeClock()
+	l := NewLedger(store)
+	l.ChatPoints = 1
+	l.ChatCooldown = time.Minute
+	l.GiftPoints = 2
+	l.SubscriptionPoints = 50
+	l.PresencePoints = 5
+	l.PresenceWindow = 10 * time.Minute
+	l.now = clock.Now
+
+	gift := api.StreamMessage{Type: api.MessageTypeGift, ID: "g1", Gift: api.GiftIceCream, Amount: "3", Sender: api.Sender{ID: "1", Username: "alice"}}
+	sub := api.StreamMessage{Type: api.MessageTypeSubscription, ID: "s1", Month: "2", Sender: api.Sender{ID: "2", Username: "bob"}}
+
+	events := []api.StreamMessage{
+		{Type: api.MessageTypeText, ID: "m1", Sender: api.Sender{ID: "1", Username: "alice"}},
+		{Type: api.MessageTypeText, ID: "m2", Sender: api.Sender{ID: "1", Username: "alice"}}, // Chat cooldown
+		gift,
+		sub,
+	}
+
+	for _, m := range events {
+		l.HandleMessage(m)
+	}
+
+	l.AwardPresence()
+
+	// Changes are only written when flushed
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected nothing saved before a flush, got %v", err)
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatalf("failed to save store: %s", err)
+	}
+
+	// A restart replays the same events, they must not be counted again
+	store, err = NewLocalPointsStore(path)
+
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+
+	l.Store = store
+	l.HandleMessage(gift)
+	l.HandleMessage(sub)
+
+	want := map[string]int64{"1": 1 + 60 + 5, "2": 100}
+
+	for id, points := range want {
+		if a, _, _ := store.Account(id); a.Points != points {
+			t.Errorf("expected user %s to have %d points, has %d", id, points, a.Points)
+		}
+	}
+
+	top, _ := store.Top(1)
+
+	if len(top) != 1 || top[0].Username != "bob" {
+		t.Errorf("expected bob to top the leaderboard, got %+v", top)
+	}
+
+	if _, _, err := store.Apply("2", "", -101, ""); err != ErrInsufficientPoints {
+		t.Errorf("expected overdraw to fail, got %v", err)
+	}
+}
+
+func TestLedger_ForgetsViewers(t *testing.T) {
+	store, _ := NewLocalPointsStore("")
+	clock := newFakeClock()
+
+	l := NewLedger(store)
+	l.ChatPoints = 1
+	l.ChatCooldown = time.Minute
+	l.PresencePoints = 5
+	l.PresenceWindow = 10 * time.Minute
+	l.now = clock.Now
+
+	l.HandleMessage(api.StreamMessage{Type: api.MessageTypeText, ID: "m1", Sender: api.Sender{ID: "1", Username: "alice"}})
+	clock.Advance(5 * time.Minute)
+	l.HandleMessage(api.StreamMessage{Type: api.MessageTypeText, ID: "m2", Sender: api.Sender{ID: "2", Username: "bob"}})
+
+	// Alice's chat cooldown is over, bob's isn't
+	l.AwardPresence()
+
+	if len(l.lastChat) != 1 || len(l.present) != 2 {
+		t.Fatalf("expected alice's chat cooldown forgotten, got %d cooldowns and %d present", len(l.lastChat), len(l.present))
+	}
+
+	clock.Advance(10 * time.Minute)
+	l.AwardPresence()
+
+	if len(l.lastChat) != 0 || len(l.present) != 0 {
+		t.Errorf("expected everyone forgotten, got %d cooldowns and %d present", len(l.lastChat), len(l.present))
+	}
+}
@@ -0,0 +1,282 @@
+package bot
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// Fields DLive reports moderation errors in
+const deleteChatField = "chatDelete"
+const banStreamChatUserField = "streamchatUserBan"
+
+// ModerationClient deletes chat messages and bans chatters, an *api.Client satisfies it
+type ModerationClient interface {
+	DeleteChat(args api.DeleteChatArgs) (api.Response, error)
+	BanStreamChatUser(args api.BanStreamChatUserArgs) (api.Response, error)
+}
+
+// Action is what the moderation engine does about a message that broke a rule
+// Actions are ordered by severity
+type Action int
+
+const (
+	ActionNone   Action = iota // Only report the verdict
+	ActionWarn                 // Reply to the chatter in chat
+	ActionDelete               // Delete the message
+	ActionBan                  // Delete the message and ban the chatter
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionNone:
+		return "none"
+	case ActionWarn:
+		return "warn"
+	case ActionDelete:
+		return "delete"
+	case ActionBan:
+		return "ban"
+	default:
+		return fmt.Sprintf("action(%d)", int(a))
+	}
+}
+
+// Policy ties a rule to what happens when a chatter breaks it
+type Policy struct {
+	Rule              Rule
+	Escalation        []Action // The action for a chatter's first strike, second strike, and so on, the last one repeats
+	ExemptSubscribers bool     // If subscribers may break the rule
+}
+
+// action gives the action for a chatter's nth strike, starting at 1
+func (p Policy) action(strike int) Action {
+	if len(p.Escalation) == 0 {
+		return ActionDelete
+	}
+
+	if strike > len(p.Escalation) {
+		strike = len(p.Escalation)
+	}
+
+	return p.Escalation[strike-1]
+}
+
+// Verdict is the outcome of a message breaking a rule
+type Verdict struct {
+	Message api.StreamMessage // The offending message
+	Rule    string            // Name of the rule that was broken
+	Strike  int               // How many times the chatter has broken a rule, including this one
+	Action  Action            // What was done about it
+	DryRun  bool              // If the action was only reported, not taken
+	Err     error             // Why the action failed, if it did
+}
+
+// Engine checks chat messages against moderation policies, and acts on the ones that break them
+// Moderators and the streamer are never moderated
+type Engine struct {
+	Client       ModerationClient
+	Streamer     string         // The streamer whose chat is being moderated
+	Policies     []Policy       // Checked in order, the first rule broken decides the action
+	Chat         *Chat          // Where warnings are sent, warnings are skipped if nil
+	Exempt       []string       // Usernames that are never moderated, such as the bot account
+	StrikeExpiry time.Duration  // How long a strike counts towards escalation, 0 keeps them forever
+	DryRun       bool           // Report verdicts without deleting, banning, or warning, for tuning rules safely
+	Logger       api.Logger     // Where verdicts are reported, silent if nil
+	Audit        *ModerationLog // Told the reason for each delete and ban before it is sent, if set
+	OnVerdict    func(v Verdict)
+
+	mu      sync.Mutex
+	strikes map[string][]time.Time // When each chatter broke a rule, by user ID
+	now     func() time.Time
+}
+
+// NewEngine creates an Engine that moderates the streamer's chat with the given policies
+func NewEngine(client ModerationClient, streamer string, policies ...Policy) *Engine {
+	return &Engine{
+		Client:   client,
+		Streamer: streamer,
+		Policies: policies,
+		strikes:  make(map[string][]time.Time),
+		now:      time.Now,
+	}
+}
+
+// HandleMessage checks a chat message against every policy, acting on the first rule it breaks
+// Returns false if the message broke no rules
+func (e *Engine) HandleMessage(m api.StreamMessage) (Verdict, bool) {
+	if m.Type != api.MessageTypeText || e.exempt(m) {
+		return Verdict{}, false
+	}
+
+	now := e.now()
+	permission := PermissionOf(m)
+
+	var broken *Policy
+
+	// Every rule sees every message, even from chatters exempt from it, so rules that track chatters over time stay accurate
+	for i := range e.Policies {
+		p := &e.Policies[i]
+
+		if !p.Rule.Check(m, now) || broken != nil {
+			continue
+		}
+
+		if !p.ExemptSubscribers || permission < PermissionSubscriber {
+			broken = p
+		}
+	}
+
+	if broken == nil {
+		return Verdict{}, false
+	}
+
+	v := Verdict{
+		Message: m,
+		Rule:    broken.Rule.Name(),
+		Strike:  e.strike(m.Sender.ID, now),
+		DryRun:  e.DryRun,
+	}
+	v.Action = broken.action(v.Strike)
+
+	if !e.DryRun {
+		v.Err = e.act(v)
+	}
+
+	l := logger(e.Logger)
+
+	if v.Err != nil {
+		l.Warn("moderation action failed", "rule", v.Rule, "action", v.Action.String(), "sender", m.Sender.Username, "error", v.Err)
+	} else {
+		l.Info("message broke rule", "rule", v.Rule, "action", v.Action.String(), "strike", v.Strike, "sender", m.Sender.Username, "dryRun", v.DryRun)
+	}
+
+	if e.OnVerdict != nil {
+		e.OnVerdict(v)
+	}
+
+	return v, true
+}
+
+// Strikes gives how many strikes a chatter currently has
+func (e *Engine) Strikes(userID string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return len(e.recentStrikes(userID, e.now()))
+}
+
+// Pardon clears a chatter's strikes
+func (e *Engine) Pardon(userID string) {
+	e.mu.Lock()
+	delete(e.strikes, userID)
+	e.mu.Unlock()
+}
+
+func (e *Engine) exempt(m api.StreamMessage) bool {
+	if PermissionOf(m) >= PermissionModerator {
+		return true
+	}
+
+	for _, u := range e.Exempt {
+		if sameUser(m, u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// strike records that a chatter broke a rule, returning how many strikes they now have
+func (e *Engine) strike(userID string, now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.strikes == nil {
+		e.strikes = make(map[string][]time.Time)
+	}
+
+	strikes := append(e.recentStrikes(userID, now), now)
+	e.strikes[userID] = strikes
+
+	return len(strikes)
+}
+
+// recentStrikes drops a chatter's expired strikes and gives the rest, the lock must be held
+func (e *Engine) recentStrikes(userID string, now time.Time) []time.Time {
+	strikes := e.strikes[userID]
+
+	if e.StrikeExpiry <= 0 {
+		return strikes
+	}
+
+	strikes = recent(strikes, now, e.StrikeExpiry)
+
+	if len(strikes) == 0 {
+		delete(e.strikes, userID)
+	} else {
+		e.strikes[userID] = strikes
+	}
+
+	return strikes
+}
+
+// act carries out the verdict's action
+func (e *Engine) act(v Verdict) error {
+	switch v.Action {
+	case ActionWarn:
+		if e.Chat == nil {
+			return nil
+		}
+
+		return e.Chat.Say(fmt.Sprintf("@%s please follow the chat rules (%s)", v.Message.Sender.Username, v.Rule))
+	case ActionDelete:
+		return e.deleteMessage(v)
+	case ActionBan:
+		// The message may already be gone, that mustn't stop the ban
+		if err := e.deleteMessage(v); err != nil {
+			logger(e.Logger).Warn("unable to delete message before ban", "rule", v.Rule, "sender", v.Message.Sender.Username, "error", err)
+		}
+
+		if e.Audit != nil {
+			e.Audit.NoteReason(ModActionBan, v.Message.Sender.Username, auditReason(v))
+		}
+
+		resp, err := e.Client.BanStreamChatUser(api.BanStreamChatUserArgs{
+			Streamer: e.Streamer,
+			Username: v.Message.Sender.Username,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return resp.MutationError(banStreamChatUserField)
+	}
+
+	return nil
+}
+
+func (e *Engine) deleteMessage(v Verdict) error {
+	if e.Audit != nil {
+		e.Audit.NoteReason(ModActionDelete, v.Message.ID, auditReason(v))
+	}
+
+	resp, err := e.Client.DeleteChat(api.DeleteChatArgs{
+		Streamer: e.Streamer,
+		ID:       v.Message.ID,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return resp.MutationError(deleteChatField)
+}
+
+// auditReason explains a verdict for the moderation log
+func auditReason(v Verdict) string {
+	return fmt.Sprintf("auto moderation: %s (strike %d)", v.Rule, v.Strike)
+}
@@ -0,0 +1,219 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// fakeModerator records every delete and ban requested through it
+type fakeModerator struct {
+	mu        sync.Mutex
+	deleted   []string
+	banned    []string
+	deleteErr error
+}
+
+func (f *fakeModerator) DeleteChat(args api.DeleteChatArgs) (api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.deleteErr != nil {
+		return api.Response{}, f.deleteErr
+	}
+
+	f.deleted = append(f.deleted, args.ID)
+
+	return api.Response{}, nil
+}
+
+func (f *fakeModerator) BanStreamChatUser(args api.BanStreamChatUserArgs) (api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.banned = append(f.banned, args.Username)
+
+	return api.Response{}, nil
+}
+
+func TestRules(t *testing.T) {
+	patterns, err := NewBannedPatterns(`(?i)free\s+lino`)
+
+	if err != nil {
+		t.Fatalf("failed to compile patterns: %s", err)
+	}
+
+	tests := []struct {
+		rule    Rule
+		content string
+		want    bool
+	}{
+		{&BannedWords{Words: []string{"Heck"}}, "what the HECK!", true},
+		{&BannedWords{Words: []string{"heck"}}, "checking in", false},
+		{patterns, "get FREE  lino here", true},
+		{&Links{Allowed: []string{"dlive.tv"}}, "watch https://clips.dlive.tv/abc", false},
+		{&Links{Allowed: []string{"dlive.tv"}}, "go to spam.example.com/now", true},
+		{&Links{}, "hello :emote/mine/dlive/wave_123: there", false},
+		{&Caps{MinLetters: 5, MaxRatio: 0.5}, "STOP SHOUTING", true},
+		{&Caps{MinLetters: 5, MaxRatio: 0.5}, "OK", false},
+		{&Emotes{Max: 2}, strings.Repeat(":emote/mine/dlive/a_1: ", 3), true},
+		{&Emotes{Max: 2}, ":emote/mine/dlive/a_1: hi", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.Check(chatMessage("1", "viewer", tt.content), time.Now()); got != tt.want {
+			t.Errorf("expected %s rule on (%s) to be %v, got %v", tt.rule.Name(), tt.content, tt.want, got)
+		}
+	}
+}
+
+func TestFlood(t *testing.T) {
+	r := &Flood{Max: 2, Window: time.Second}
+	now := time.Now()
+
+	for i, want := range []bool{false, false, true} {
+		if got := r.Check(chatMessage("1", "viewer", "hi"), now); got != want {
+			t.Errorf("message %d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	if r.Check(chatMessage("2", "other", "hi"), now) {
+		t.Error("expected other chatters to be counted separately")
+	}
+
+	if r.Check(chatMessage("1", "viewer", "hi"), now.Add(2*time.Second)) {
+		t.Error("expected old messages to leave the window")
+	}
+}
+
+func TestEngine_Escalation(t *testing.T) {
+	client := &fakeModerator{}
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	e := NewEngine(client, "streamer", Policy{
+		Rule:              &BannedWords{Words: []string{"spam"}},
+		Escalation:        []Action{ActionWarn, ActionDelete, ActionBan},
+		ExemptSubscribers: true,
+	})
+	e.Chat = &Chat{Sender: sender}
+	e.StrikeExpiry = time.Hour
+	e.now = clock.Now
+
+	var verdicts []Verdict
+
+	e.OnVerdict = func(v Verdict) {
+		verdicts = append(verdicts, v)
+	}
+
+	for i := 0; i < 3; i++ {
+		m := chatMessage("1", "viewer", "spam")
+		m.ID = string(rune('a' + i))
+		e.HandleMessage(m)
+	}
+
+	subscriber := chatMessage("2", "fan", "spam")
+	subscriber.Subscribing = true
+	moderator := chatMessage("3", "mod", "spam")
+	moderator.RoomRole = api.RoomRoleModerator
+
+	for _, m := range []api.StreamMessage{subscriber, moderator} {
+		if _, ok := e.HandleMessage(m); ok {
+			t.Errorf("expected %s to be exempt", m.Sender.Username)
+		}
+	}
+
+	want := []Action{ActionWarn, ActionDelete, ActionBan}
+
+	if len(verdicts) != len(want) {
+		t.Fatalf("expected %d verdicts, got %d", len(want), len(verdicts))
+	}
+
+	for i, v := range verdicts {
+		if v.Action != want[i] || v.Strike != i+1 {
+			t.Errorf("verdict %d: expected strike %d to %s, got strike %d to %s", i, i+1, want[i], v.Strike, v.Action)
+		}
+	}
+
+	if len(sender.messages()) != 1 || len(client.deleted) != 2 || len(client.banned) != 1 {
+		t.Errorf("expected 1 warning, 2 deletes, and 1 ban, got %d, %d, and %d", len(sender.messages()), len(client.deleted), len(client.banned))
+	}
+
+	clock.Advance(2 * time.Hour)
+
+	if n := e.Strikes("1"); n != 0 {
+		t.Errorf("expected strikes to expire, have %d", n)
+	}
+}
+
+func TestEngine_DryRun(t *testing.T) {
+	client := &fakeModerator{}
+
+	e := NewEngine(client, "streamer", Policy{
+		Rule:       &Caps{MinLetters: 1, MaxRatio: 0.5},
+		Escalation: []Action{ActionBan},
+	})
+	e.DryRun = true
+
+	v, ok := e.HandleMessage(chatMessage("1", "viewer", "LOUD"))
+
+	if !ok || v.Action != ActionBan || !v.DryRun {
+		t.Errorf("expected a dry run ban verdict, got %+v", v)
+	}
+
+	if len(client.deleted) != 0 || len(client.banned) != 0 {
+		t.Error("expected dry run to take no action")
+	}
+}
+
+// countingRule is broken by every message, counting the messages it checks
+type countingRule struct {
+	checked int
+}
+
+func (r *countingRule) Name() string { return "counting" }
+
+func (r *countingRule) Check(m api.StreamMessage, now time.Time) bool {
+	r.checked++
+	return true
+}
+
+func TestEngine_ExemptSubscribersChecked(t *testing.T) {
+	rule := &countingRule{}
+
+	e := NewEngine(&fakeModerator{}, "streamer", Policy{Rule: rule, ExemptSubscribers: true})
+
+	subscriber := chatMessage("1", "fan", "hi")
+	subscriber.Subscribing = true
+
+	if _, ok := e.HandleMessage(subscriber); ok {
+		t.Error("expected the subscriber to be exempt")
+	}
+
+	if rule.checked != 1 {
+		t.Errorf("expected the rule to still see the exempt message, checked %d", rule.checked)
+	}
+}
+
+func TestEngine_BanAfterFailedDelete(t *testing.T) {
+	client := &fakeModerator{deleteErr: errors.New("already deleted")}
+
+	e := NewEngine(client, "streamer", Policy{
+		Rule:       &BannedWords{Words: []string{"spam"}},
+		Escalation: []Action{ActionBan},
+	})
+
+	v, ok := e.HandleMessage(chatMessage("1", "viewer", "spam"))
+
+	if !ok || v.Err != nil {
+		t.Fatalf("expected the ban to succeed, got %+v", v)
+	}
+
+	if len(client.banned) != 1 || client.banned[0] != "viewer" {
+		t.Errorf("expected viewer banned, got %v", client.banned)
+	}
+}
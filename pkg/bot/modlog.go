@@ -0,0 +1,312 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// modLogSeenLimit is how many chat event IDs a ModerationLog remembers, so replayed events aren't recorded twice
+const modLogSeenLimit = 1000
+
+// reasonTimeout is how long a reason noted with NoteReason waits for its mutation
+const reasonTimeout = time.Minute
+
+// Moderation actions recorded in a ModerationLog
+const (
+	ModActionBan             = "ban"
+	ModActionUnban           = "unban"
+	ModActionDelete          = "delete"
+	ModActionAddModerator    = "add_moderator"
+	ModActionRemoveModerator = "remove_moderator"
+	ModActionChangeMode      = "change_mode"
+)
+
+// Where a moderation entry came from
+const (
+	ModSourceChat   = "chat"   // An event in the streamer's chat, from anyone moderating, including on the website
+	ModSourceClient = "client" // A mutation sent by this program's client
+)
+
+// modMutations maps moderation mutation operation names to the action they take
+var modMutations = map[string]string{
+	"BanStreamChatUser":   ModActionBan,
+	"UnbanStreamChatUser": ModActionUnban,
+	"DeleteChat":          ModActionDelete,
+	"AddModerator":        ModActionAddModerator,
+	"RemoveModerator":     ModActionRemoveModerator,
+}
+
+// ModerationEntry is a single moderation action
+// Actions taken by the client are seen twice when the chat is also watched, once from each source
+type ModerationEntry struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"` // ModSourceChat or ModSourceClient
+	Action     string    `json:"action"` // One of the ModAction constants
+	Streamer   string    `json:"streamer,omitempty"`
+	Actor      string    `json:"actor,omitempty"`  // Username of who took the action, only known for entries from the client
+	Target     string    `json:"target,omitempty"` // Username of who the action was taken against
+	MessageIDs []string  `json:"messageIDs,omitempty"`
+	Mode       string    `json:"mode,omitempty"` // The chat mode that was set
+	Reason     string    `json:"reason,omitempty"`
+	EventID    string    `json:"eventID,omitempty"` // ID of the chat event the entry came from
+	Error      string    `json:"error,omitempty"`   // Why a mutation failed
+}
+
+// ModerationFilter picks entries out of a ModerationLog, empty fields match everything
+type ModerationFilter struct {
+	User    string    // Matches entries where the user was the actor or the target, ignoring case
+	Actions []string  // Matches entries with any of these actions
+	Since   time.Time // Matches entries at or after this time
+	Until   time.Time // Matches entries before this time
+}
+
+func (f ModerationFilter) match(e ModerationEntry) bool {
+	if f.User != "" && !strings.EqualFold(e.Actor, f.User) && !strings.EqualFold(e.Target, f.User) {
+		return false
+	}
+
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+
+	if len(f.Actions) == 0 {
+		return true
+	}
+
+	for _, a := range f.Actions {
+		if a == e.Action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noteReason is a reason waiting for the mutation it explains
+type noteReason struct {
+	reason string
+	at     time.Time
+}
+
+// ModerationLog records moderation seen in a streamer's chat and taken by the client to a JSON lines file
+// Use HandleMessage with the chat's events, and HandleRequest as the client's api.SendHook, combined with any others using api.SendHooks
+type ModerationLog struct {
+	Streamer string     // The streamer whose chat is moderated
+	Actor    string     // Username of the account the client is authorized as, recorded as the actor of its mutations
+	Logger   api.Logger // Where failures to write the log are reported, silent if nil
+
+	path    string
+	mu      sync.Mutex
+	seen    *recentIDs
+	reasons map[string]noteReason // Reasons for upcoming mutations, by action and target
+	now     func() time.Time
+}
+
+// NewModerationLog creates a ModerationLog appending to the file at path
+func NewModerationLog(path string, streamer string) *ModerationLog {
+	return &ModerationLog{
+		Streamer: streamer,
+		path:     path,
+		seen:     newRecentIDs(modLogSeenLimit),
+		reasons:  make(map[string]noteReason),
+		now:      time.Now,
+	}
+}
+
+// Record appends an entry to the log, setting its time and streamer if they are missing
+func (l *ModerationLog) Record(e ModerationEntry) error {
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+
+	if e.Streamer == "" {
+		e.Streamer = l.Streamer
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return appendJSONLine(l.path, e)
+}
+
+// NoteReason gives the reason for a mutation the client is about to send, so it is recorded with it
+// target is the username for bans and moderator changes, and the message ID for deletes
+func (l *ModerationLog) NoteReason(action string, target string, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	for k, r := range l.reasons {
+		if now.Sub(r.at) > reasonTimeout {
+			delete(l.reasons, k)
+		}
+	}
+
+	l.reasons[action+"\x00"+strings.ToLower(target)] = noteReason{reason: reason, at: now}
+}
+
+// ForgetReason drops a reason given with NoteReason, such as when its mutation couldn't be sent
+func (l *ModerationLog) ForgetReason(action string, target string) {
+	l.mu.Lock()
+	delete(l.reasons, action+"\x00"+strings.ToLower(target))
+	l.mu.Unlock()
+}
+
+// HandleMessage records moderation events from the streamer's chat
+// The chat feed doesn't say who took an action, so these entries have no actor
+func (l *ModerationLog) HandleMessage(m api.StreamMessage) {
+	e := ModerationEntry{
+		Source:  ModSourceChat,
+		Target:  m.Sender.Username,
+		EventID: m.ID,
+	}
+
+	switch m.Type {
+	case api.MessageTypeBan:
+		e.Action = ModActionBan
+	case api.MessageTypeDelete:
+		e.Action = ModActionDelete
+		e.Target = ""
+		e.MessageIDs = m.IDs
+		e.EventID = "delete:" + strings.Join(m.IDs, ",")
+	case api.MessageTypeModerator:
+		e.Action = ModActionRemoveModerator
+
+		if m.Add {
+			e.Action = ModActionAddModerator
+		}
+	case api.MessageTypeChangeMode:
+		e.Action = ModActionChangeMode
+		e.Target = ""
+		e.Mode = m.Mode
+	default:
+		return
+	}
+
+	l.mu.Lock()
+	fresh := e.EventID == "" || l.seen.add(e.EventID)
+	l.mu.Unlock()
+
+	if fresh {
+		l.record(e)
+	}
+}
+
+// HandleRequest records moderation mutations sent by the client, it is an api.SendHook
+func (l *ModerationLog) HandleRequest(req api.Request, resp api.Response, err error) {
+	op := req.OperationName()
+	action, ok := modMutations[op]
+
+	if !ok {
+		return
+	}
+
+	var vars struct {
+		Streamer string `json:"streamer"`
+		Username string `json:"username"`
+		ID       string `json:"id"`
+	}
+
+	if b, err := json.Marshal(req.Vars); err == nil {
+		_ = json.Unmarshal(b, &vars)
+	}
+
+	e := ModerationEntry{
+		Source:   ModSourceClient,
+		Action:   action,
+		Streamer: vars.Streamer,
+		Actor:    l.Actor,
+		Target:   vars.Username,
+	}
+
+	key := vars.Username
+
+	if action == ModActionDelete {
+		e.MessageIDs = []string{vars.ID}
+		key = vars.ID
+	}
+
+	if err == nil {
+		err = resp.MutationError(mutationField(resp))
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	k := action + "\x00" + strings.ToLower(key)
+
+	if r, ok := l.reasons[k]; ok {
+		e.Reason = r.reason
+		delete(l.reasons, k)
+	}
+
+	l.mu.Unlock()
+
+	l.record(e)
+}
+
+// Query gives the entries in the log that match the filter, oldest first
+func (l *ModerationLog) Query(filter ModerationFilter) ([]ModerationEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var entries []ModerationEntry
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for s.Scan() {
+		var e ModerationEntry
+
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// Skip a line cut short by a crash, rather than losing the whole log
+			continue
+		}
+
+		if filter.match(e) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, s.Err()
+}
+
+func (l *ModerationLog) record(e ModerationEntry) {
+	if err := l.Record(e); err != nil {
+		logger(l.Logger).Error("unable to record moderation", "action", e.Action, "target", e.Target, "error", err)
+	}
+}
+
+// mutationField gives the single field of a mutation's response data
+func mutationField(resp api.Response) string {
+	for k := range resp.Data {
+		return k
+	}
+
+	return ""
+}
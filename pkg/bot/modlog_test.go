@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestModerationLog(t *testing.T) {
+	clock := newFakeClock()
+	l := NewModerationLog(filepath.Join(t.TempDir(), "moderation.jsonl"), "streamer")
+	l.Actor = "bot"
+	l.now = clock.Now
+
+	ban := api.StreamMessage{Type: api.MessageTypeBan, ID: "b1", Sender: api.Sender{Username: "troll"}}
+
+	l.HandleMessage(ban)
+	l.HandleMessage(ban) // Replayed
+	l.HandleMessage(chatMessage("1", "viewer", "not moderation"))
+
+	clock.Advance(time.Hour)
+
+	l.NoteReason(ModActionDelete, "m1", "spam")
+	l.HandleRequest(api.Request{Query: api.DeleteChatMutation(), Vars: api.DeleteChatArgs{Streamer: "streamer", ID: "m1"}}, api.Response{}, nil)
+	l.HandleRequest(api.Request{Query: api.UnbanStreamChatUserMutation(), Vars: api.UnbanStreamChatUserArgs{Streamer: "streamer", Username: "Troll"}}, api.Response{}, errors.New("offline"))
+	l.HandleRequest(api.Request{Query: api.SendStreamChatMessageMutation()}, api.Response{}, nil)
+
+	all, err := l.Query(ModerationFilter{})
+
+	if err != nil {
+		t.Fatalf("failed to query log: %s", err)
+	}
+
+	if len(all) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", all)
+	}
+
+	// The chat feed doesn't say who banned troll
+	if b := all[0]; b.Action != ModActionBan || b.Source != ModSourceChat || b.Actor != "" || b.Target != "troll" {
+		t.Errorf("expected ban of troll from chat without an actor, got %+v", b)
+	}
+
+	if d := all[1]; d.Action != ModActionDelete || d.Reason != "spam" || d.Actor != "bot" || d.Source != ModSourceClient {
+		t.Errorf("expected delete by bot for spam, got %+v", d)
+	}
+
+	troll, _ := l.Query(ModerationFilter{User: "TROLL"})
+
+	if len(troll) != 2 || troll[1].Action != ModActionUnban || troll[1].Error != "offline" {
+		t.Errorf("expected ban and failed unban for troll, got %+v", troll)
+	}
+
+	recent, _ := l.Query(ModerationFilter{Since: clock.Now()})
+
+	if len(recent) != 2 {
+		t.Errorf("expected 2 recent entries, got %d", len(recent))
+	}
+}
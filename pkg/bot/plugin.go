@@ -0,0 +1,673 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultPluginRateLimit is how many chat messages a plugin may send in a channel within the rate window, if the host's RateLimit is 0
+const DefaultPluginRateLimit = 5
+
+// DefaultPluginRateWindow is the window a plugin's chat messages are counted in, if the host's RateWindow is 0
+const DefaultPluginRateWindow = 30 * time.Second
+
+// DefaultPluginBuffer is how many events are queued for a plugin before more are dropped, if the host's Buffer is 0
+const DefaultPluginBuffer = 100
+
+// ErrRateLimited is given when a plugin sends more chat messages than its host allows
+var ErrRateLimited = errors.New("too many chat messages sent")
+
+// Plugin is a bot feature run by a PluginHost, with an instance for each channel it is enabled in
+// Init is called before any events are given, and Shutdown once no more will be
+// HandleMessage is called from a goroutine of the plugin's own, one event at a time
+// A CommandPlugin's commands run on the same goroutine, in turn with its events, so a plugin never needs to lock its own state
+type Plugin interface {
+	Init(p *PluginContext) error
+	HandleMessage(m api.StreamMessage)
+	Shutdown() error
+}
+
+// CommandPlugin is a Plugin with chat commands, registered with the channel's Router while the plugin is enabled
+// Replies to the commands are sent with the plugin's rate limited chat, and failed commands are logged
+type CommandPlugin interface {
+	Plugin
+	Commands() []Command
+}
+
+// EventFilter is a Plugin that only wants some kinds of chat events, given as api.MessageType constants
+type EventFilter interface {
+	Plugin
+	Events() []string
+}
+
+// PluginFactory creates an instance of a plugin for a channel
+type PluginFactory func() Plugin
+
+// PluginContext is what a plugin is given when it starts in a channel
+type PluginContext struct {
+	Context  context.Context // Done when the plugin is disabled or the host shuts down
+	Name     string          // The name the plugin was registered with
+	Streamer string          // The streamer whose chat the plugin is running in
+	Chat     Chat            // The channel's chat, rate limited for this plugin
+	Logger   api.Logger      // The host's logger, never nil
+}
+
+// PluginConfig says which plugins are enabled in each channel
+// It is read from JSON such as {"default": ["alerts"], "channels": {"streamer": ["alerts", "points"]}}
+type PluginConfig struct {
+	Default  []string            `json:"default"`  // Plugins enabled in channels that aren't listed
+	Channels map[string][]string `json:"channels"` // Plugins enabled in each channel, by streamer
+}
+
+// LoadPluginConfig reads a PluginConfig from a JSON file
+func LoadPluginConfig(path string) (PluginConfig, error) {
+	var cfg PluginConfig
+
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("unable to read plugin config from (%s): %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Enabled gives the plugins enabled in the streamer's channel
+func (c PluginConfig) Enabled(streamer string) []string {
+	for s, plugins := range c.Channels {
+		if strings.EqualFold(s, streamer) {
+			return plugins
+		}
+	}
+
+	return c.Default
+}
+
+// pluginTask is work for a plugin's goroutine, either an event or a command
+type pluginTask struct {
+	event   api.StreamMessage
+	command *CommandContext               // The command to run instead of giving an event, if set
+	handler func(c *CommandContext) error // The plugin's handler for the command
+}
+
+// pluginInstance is a plugin running in a channel
+type pluginInstance struct {
+	name     string
+	plugin   Plugin
+	events   chan pluginTask
+	filter   map[string]bool // Event types the plugin wants, every type if nil
+	commands []string        // Names of the commands registered for it
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed once the plugin's goroutine has finished its last task
+}
+
+// pluginChannel is a channel a PluginHost has joined
+type pluginChannel struct {
+	ctx     context.Context
+	router  *Router
+	plugins map[string]*pluginInstance
+}
+
+// PluginHost runs plugins in one or more channels, giving each its own event stream and rate limited chat
+// A plugin that panics has the panic logged, and keeps running with the next event
+type PluginHost struct {
+	Sender     ChatSender    // Sends the plugins' chat messages, such as a ChatQueue
+	Prefix     string        // What commands start with in each channel, DefaultPrefix if empty
+	Self       string        // The bot account's username, its own messages aren't given to plugins
+	RateLimit  int           // Chat messages each plugin may send in a channel within RateWindow, DefaultPluginRateLimit if 0
+	RateWindow time.Duration // DefaultPluginRateWindow if 0
+	Buffer     int           // Events queued for each plugin before more are dropped, DefaultPluginBuffer if 0
+	Logger     api.Logger    // Where plugin failures are reported, silent if nil
+
+	mu        sync.Mutex
+	config    PluginConfig
+	factories map[string]PluginFactory
+	channels  map[string]*pluginChannel
+	now       func() time.Time
+}
+
+// NewPluginHost creates a PluginHost sending chat messages with the sender, enabling plugins as the config says
+func NewPluginHost(sender ChatSender, config PluginConfig) *PluginHost {
+	return &PluginHost{
+		Sender:    sender,
+		config:    config,
+		factories: make(map[string]PluginFactory),
+		channels:  make(map[string]*pluginChannel),
+		now:       time.Now,
+	}
+}
+
+// Register adds a plugin the host can run, under a unique name
+func (h *PluginHost) Register(name string, factory PluginFactory) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.factories[name]; ok {
+		return fmt.Errorf("plugin (%s) is already registered", name)
+	}
+
+	h.factories[name] = factory
+
+	return nil
+}
+
+// Plugins gives the names of the registered plugins, sorted
+func (h *PluginHost) Plugins() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	names := make([]string, 0, len(h.factories))
+
+	for name := range h.factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Join starts the plugins enabled in the streamer's channel, their contexts are done when ctx is or the channel is left
+// Plugins that fail to start are reported, the first failure is returned once the others have started
+func (h *PluginHost) Join(ctx context.Context, streamer string) error {
+	router := NewRouter(Chat{Sender: h.Sender, Streamer: streamer})
+	router.Prefix = h.Prefix
+	router.Self = h.Self
+	router.Logger = h.Logger
+
+	h.mu.Lock()
+
+	if _, ok := h.channels[streamer]; ok {
+		h.mu.Unlock()
+		return fmt.Errorf("already joined the chat of (%s)", streamer)
+	}
+
+	h.channels[streamer] = &pluginChannel{
+		ctx:     ctx,
+		router:  router,
+		plugins: make(map[string]*pluginInstance),
+	}
+
+	enabled := h.config.Enabled(streamer)
+	h.mu.Unlock()
+
+	var first error
+
+	for _, name := range enabled {
+		if err := h.Enable(streamer, name); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Leave shuts down every plugin in the streamer's channel
+func (h *PluginHost) Leave(streamer string) error {
+	h.mu.Lock()
+
+	ch, ok := h.channels[streamer]
+
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("not in the chat of (%s)", streamer)
+	}
+
+	delete(h.channels, streamer)
+
+	instances := make([]*pluginInstance, 0, len(ch.plugins))
+
+	for name, p := range ch.plugins {
+		instances = append(instances, p)
+		h.detach(ch, name)
+	}
+
+	h.mu.Unlock()
+
+	var first error
+
+	for _, p := range instances {
+		if err := h.shutdown(streamer, p); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Shutdown leaves every channel
+func (h *PluginHost) Shutdown() error {
+	var first error
+
+	for _, streamer := range h.Channels() {
+		if err := h.Leave(streamer); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Channels gives the streamers whose chat the host has joined, sorted
+func (h *PluginHost) Channels() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	streamers := make([]string, 0, len(h.channels))
+
+	for s := range h.channels {
+		streamers = append(streamers, s)
+	}
+
+	sort.Strings(streamers)
+
+	return streamers
+}
+
+// Router gives the Router plugin commands are registered with in the streamer's channel, nil if it hasn't been joined
+func (h *PluginHost) Router(streamer string) *Router {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ch, ok := h.channels[streamer]; ok {
+		return ch.router
+	}
+
+	return nil
+}
+
+// Enable starts the named plugin in the streamer's channel
+func (h *PluginHost) Enable(streamer string, name string) error {
+	h.mu.Lock()
+
+	ch, ok := h.channels[streamer]
+
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("not in the chat of (%s)", streamer)
+	}
+
+	factory, ok := h.factories[name]
+
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("no plugin registered as (%s)", name)
+	}
+
+	if _, ok := ch.plugins[name]; ok {
+		h.mu.Unlock()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ch.ctx)
+	h.mu.Unlock()
+
+	p := &pluginInstance{
+		name:   name,
+		events: make(chan pluginTask, h.buffer()),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	pc := &PluginContext{
+		Context:  ctx,
+		Name:     name,
+		Streamer: streamer,
+		Chat: Chat{
+			Sender:   &rateLimitedSender{sender: h.Sender, limit: h.rateLimit(), window: h.rateWindow(), now: h.now},
+			Streamer: streamer,
+		},
+		Logger: logger(h.Logger),
+	}
+
+	err := h.protect(name, streamer, "factory", func() error {
+		p.plugin = factory()
+		return nil
+	})
+
+	if err == nil {
+		err = h.protect(name, streamer, "init", func() error {
+			return p.plugin.Init(pc)
+		})
+	}
+
+	if err != nil {
+		cancel()
+		logger(h.Logger).Error("unable to start plugin", "plugin", name, "streamer", streamer, "error", err)
+		return err
+	}
+
+	if f, ok := p.plugin.(EventFilter); ok {
+		p.filter = make(map[string]bool)
+
+		for _, t := range f.Events() {
+			p.filter[t] = true
+		}
+	}
+
+	if err := h.attach(streamer, ch, p, pc); err != nil {
+		// It never had any events to give
+		close(p.events)
+		close(p.done)
+		_ = h.shutdown(streamer, p)
+
+		return err
+	}
+
+	go h.deliver(streamer, p)
+
+	logger(h.Logger).Info("plugin started", "plugin", name, "streamer", streamer)
+
+	return nil
+}
+
+// Disable shuts down the named plugin in the streamer's channel
+func (h *PluginHost) Disable(streamer string, name string) error {
+	h.mu.Lock()
+
+	ch, ok := h.channels[streamer]
+
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("not in the chat of (%s)", streamer)
+	}
+
+	p, ok := ch.plugins[name]
+
+	if !ok {
+		h.mu.Unlock()
+		return nil
+	}
+
+	h.detach(ch, name)
+	h.mu.Unlock()
+
+	return h.shutdown(streamer, p)
+}
+
+// SetConfig replaces the config, enabling and disabling plugins in joined channels to match it
+func (h *PluginHost) SetConfig(config PluginConfig) error {
+	h.mu.Lock()
+	h.config = config
+
+	type change struct {
+		streamer string
+		name     string
+		enable   bool
+	}
+
+	var changes []change
+
+	for streamer, ch := range h.channels {
+		want := make(map[string]bool)
+
+		for _, name := range config.Enabled(streamer) {
+			want[name] = true
+
+			if _, ok := ch.plugins[name]; !ok {
+				changes = append(changes, change{streamer, name, true})
+			}
+		}
+
+		for name := range ch.plugins {
+			if !want[name] {
+				changes = append(changes, change{streamer, name, false})
+			}
+		}
+	}
+
+	h.mu.Unlock()
+
+	var first error
+
+	for _, c := range changes {
+		var err error
+
+		if c.enable {
+			err = h.Enable(c.streamer, c.name)
+		} else {
+			err = h.Disable(c.streamer, c.name)
+		}
+
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// HandleMessage gives the event to the channel's plugins that want it, and dispatches commands in the event's channel
+// A plugin that has fallen behind by more than the buffer misses the event, or the command
+func (h *PluginHost) HandleMessage(m api.AggregatedMessage) {
+	if sameUser(m.StreamMessage, h.Self) {
+		return
+	}
+
+	h.mu.Lock()
+
+	ch, ok := h.channels[m.Streamer]
+
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+
+	router := ch.router
+
+	for _, p := range ch.plugins {
+		if p.filter != nil && !p.filter[m.Type] {
+			continue
+		}
+
+		h.offer(m.Streamer, p, pluginTask{event: m.StreamMessage})
+	}
+
+	h.mu.Unlock()
+
+	router.HandleMessage(m.StreamMessage)
+}
+
+// attach registers the plugin's commands and adds it to the channel
+func (h *PluginHost) attach(streamer string, ch *pluginChannel, p *pluginInstance, pc *PluginContext) error {
+	var commands []Command
+
+	if c, ok := p.plugin.(CommandPlugin); ok {
+		if err := h.protect(p.name, streamer, "commands", func() error {
+			commands = c.Commands()
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The channel may have been left while the plugin started
+	if h.channels[streamer] != ch {
+		return fmt.Errorf("not in the chat of (%s)", streamer)
+	}
+
+	if _, ok := ch.plugins[p.name]; ok {
+		return fmt.Errorf("plugin (%s) is already running in the chat of (%s)", p.name, streamer)
+	}
+
+	for _, cmd := range commands {
+		handler := cmd.Handler
+
+		// Handed to the plugin's goroutine, so it doesn't run at the same time as the plugin's events
+		cmd.Handler = func(c *CommandContext) error {
+			c.Chat = pc.Chat
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			// The plugin may have been disabled since the router found the command
+			if ch.plugins[p.name] == p {
+				h.offer(streamer, p, pluginTask{command: c, handler: handler})
+			}
+
+			return nil
+		}
+
+		if err := ch.router.Handle(cmd); err != nil {
+			for _, name := range p.commands {
+				ch.router.Remove(name)
+			}
+
+			p.commands = nil
+
+			return fmt.Errorf("plugin (%s): %w", p.name, err)
+		}
+
+		p.commands = append(p.commands, cmd.Name)
+	}
+
+	ch.plugins[p.name] = p
+
+	return nil
+}
+
+// detach removes the plugin from the channel and stops its events, the lock must be held
+func (h *PluginHost) detach(ch *pluginChannel, name string) {
+	p := ch.plugins[name]
+
+	for _, cmd := range p.commands {
+		ch.router.Remove(cmd)
+	}
+
+	delete(ch.plugins, name)
+	close(p.events)
+}
+
+// offer queues a task for the plugin, dropping it if the plugin is behind, the lock must be held
+func (h *PluginHost) offer(streamer string, p *pluginInstance, t pluginTask) {
+	select {
+	case p.events <- t:
+	default:
+		if t.command != nil {
+			logger(h.Logger).Warn("plugin is behind, dropped command", "plugin", p.name, "streamer", streamer, "command", t.command.Command.Name)
+		} else {
+			logger(h.Logger).Warn("plugin is behind, dropped event", "plugin", p.name, "streamer", streamer, "type", t.event.Type)
+		}
+	}
+}
+
+// deliver gives the plugin its events and runs its commands until they are stopped
+func (h *PluginHost) deliver(streamer string, p *pluginInstance) {
+	defer close(p.done)
+
+	for t := range p.events {
+		if t.command != nil {
+			c := t.command
+
+			if err := h.protect(p.name, streamer, "command "+c.Command.Name, func() error {
+				return t.handler(c)
+			}); err != nil {
+				logger(h.Logger).Warn("command failed", "plugin", p.name, "streamer", streamer, "command", c.Command.Name, "sender", c.Message.Sender.Username, "error", err)
+			}
+
+			continue
+		}
+
+		if err := h.protect(p.name, streamer, "event", func() error {
+			p.plugin.HandleMessage(t.event)
+			return nil
+		}); err != nil {
+			logger(h.Logger).Error("plugin failed to handle event", "plugin", p.name, "streamer", streamer, "error", err)
+		}
+	}
+}
+
+// shutdown waits for the plugin to finish its events, then shuts it down
+func (h *PluginHost) shutdown(streamer string, p *pluginInstance) error {
+	<-p.done
+	p.cancel()
+
+	err := h.protect(p.name, streamer, "shutdown", p.plugin.Shutdown)
+
+	if err != nil {
+		logger(h.Logger).Error("plugin failed to shut down", "plugin", p.name, "streamer", streamer, "error", err)
+	} else {
+		logger(h.Logger).Info("plugin stopped", "plugin", p.name, "streamer", streamer)
+	}
+
+	return err
+}
+
+// protect runs one of a plugin's hooks, turning a panic into an error
+func (h *PluginHost) protect(name string, streamer string, hook string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin (%s) panicked in %s in the chat of (%s): %v", name, hook, streamer, r)
+		}
+	}()
+
+	return f()
+}
+
+func (h *PluginHost) buffer() int {
+	if h.Buffer <= 0 {
+		return DefaultPluginBuffer
+	}
+
+	return h.Buffer
+}
+
+func (h *PluginHost) rateLimit() int {
+	if h.RateLimit <= 0 {
+		return DefaultPluginRateLimit
+	}
+
+	return h.RateLimit
+}
+
+func (h *PluginHost) rateWindow() time.Duration {
+	if h.RateWindow <= 0 {
+		return DefaultPluginRateWindow
+	}
+
+	return h.RateWindow
+}
+
+// rateLimitedSender refuses messages once too many have been sent within the window
+type rateLimitedSender struct {
+	sender ChatSender
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+func (s *rateLimitedSender) SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error) {
+	s.mu.Lock()
+
+	now := s.now()
+	s.sent = recent(s.sent, now, s.window)
+
+	if len(s.sent) >= s.limit {
+		s.mu.Unlock()
+		return api.Response{}, ErrRateLimited
+	}
+
+	s.sent = append(s.sent, now)
+	s.mu.Unlock()
+
+	return s.sender.SendStreamChat(args)
+}
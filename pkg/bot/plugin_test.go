@@ -0,0 +1,166 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+type testPlugin struct {
+	mu       sync.Mutex
+	events   []string
+	shutdown bool
+}
+
+func (p *testPlugin) Init(pc *PluginContext) error { return nil }
+
+func (p *testPlugin) HandleMessage(m api.StreamMessage) {
+	if m.Content == "panic" {
+		panic("bad event")
+	}
+
+	p.mu.Lock()
+	p.events = append(p.events, m.Content)
+	p.mu.Unlock()
+}
+
+func (p *testPlugin) Shutdown() error {
+	p.mu.Lock()
+	p.shutdown = true
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *testPlugin) Events() []string { return []string{api.MessageTypeText} }
+
+func (p *testPlugin) Commands() []Command {
+	return []Command{{
+		Name: "ping",
+		Handler: func(c *CommandContext) error {
+			return c.Reply("pong")
+		},
+	}}
+}
+
+func TestPluginHost(t *testing.T) {
+	sender := &fakeSender{}
+	plugins := make(map[string]*testPlugin)
+
+	h := NewPluginHost(sender, PluginConfig{Channels: map[string][]string{"streamer": {"test"}}})
+	h.RateLimit = 1
+
+	if err := h.Register("test", func() Plugin { p := &testPlugin{}; plugins["test"] = p; return p }); err != nil {
+		t.Fatalf("failed to register plugin: %s", err)
+	}
+
+	if err := h.Join(context.Background(), "streamer"); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+
+	if err := h.Join(context.Background(), "other"); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+
+	for _, m := range []api.AggregatedMessage{
+		{Streamer: "streamer", StreamMessage: chatMessage("1", "viewer", "panic")},
+		{Streamer: "streamer", StreamMessage: api.StreamMessage{Type: api.MessageTypeFollow}},
+		{Streamer: "streamer", StreamMessage: chatMessage("1", "viewer", "!ping")},
+		{Streamer: "streamer", StreamMessage: chatMessage("2", "viewer2", "!ping")},
+		{Streamer: "other", StreamMessage: chatMessage("1", "viewer", "!ping")},
+	} {
+		h.HandleMessage(m)
+	}
+
+	if got := h.Router("other").Commands(); len(got) != 0 {
+		t.Errorf("expected no commands where the plugin isn't enabled, got %v", got)
+	}
+
+	if err := h.SetConfig(PluginConfig{}); err != nil {
+		t.Fatalf("failed to set config: %s", err)
+	}
+
+	// Disabling waits for the plugin's commands as well as its events
+	if sent := sender.messages(); len(sent) != 1 || sent[0] != "pong" {
+		t.Errorf("expected one rate limited pong, got %v", sent)
+	}
+
+	p := plugins["test"]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Disabling waits for the plugin to finish its events
+	if !p.shutdown || len(p.events) != 2 {
+		t.Errorf("expected the plugin to survive a panic, see both commands, and shut down, got %v", p.events)
+	}
+
+	if h.Router("streamer").HandleMessage(chatMessage("1", "viewer", "!ping")) {
+		t.Error("expected the plugin's command to be removed")
+	}
+}
+
+// overlapPlugin records if its command ever runs at the same time as its event handler
+type overlapPlugin struct {
+	running int32
+	overlap int32
+	handled int32
+}
+
+func (p *overlapPlugin) enter() {
+	if atomic.AddInt32(&p.running, 1) > 1 {
+		atomic.StoreInt32(&p.overlap, 1)
+	}
+
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&p.handled, 1)
+	atomic.AddInt32(&p.running, -1)
+}
+
+func (p *overlapPlugin) Init(pc *PluginContext) error      { return nil }
+func (p *overlapPlugin) HandleMessage(m api.StreamMessage) { p.enter() }
+func (p *overlapPlugin) Shutdown() error                   { return nil }
+
+func (p *overlapPlugin) Commands() []Command {
+	return []Command{{
+		Name: "work",
+		Handler: func(c *CommandContext) error {
+			p.enter()
+			return nil
+		},
+	}}
+}
+
+func TestPluginHost_CommandsWithEvents(t *testing.T) {
+	p := &overlapPlugin{}
+
+	h := NewPluginHost(&fakeSender{}, PluginConfig{Default: []string{"overlap"}})
+
+	if err := h.Register("overlap", func() Plugin { return p }); err != nil {
+		t.Fatalf("failed to register plugin: %s", err)
+	}
+
+	if err := h.Join(context.Background(), "streamer"); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+
+	// Each message is an event for the plugin as well as a command
+	for i := 0; i < 20; i++ {
+		h.HandleMessage(api.AggregatedMessage{Streamer: "streamer", StreamMessage: chatMessage("1", "viewer", "!work")})
+	}
+
+	if err := h.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down: %s", err)
+	}
+
+	if atomic.LoadInt32(&p.overlap) != 0 {
+		t.Error("expected the plugin's command never to run at the same time as its event handler")
+	}
+
+	if n := atomic.LoadInt32(&p.handled); n != 40 {
+		t.Errorf("expected 20 events and 20 commands handled, got %d", n)
+	}
+}
@@ -0,0 +1,268 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// seenEventLimit is how many event IDs a LocalPointsStore remembers, older ones are forgotten first
+const seenEventLimit = 10000
+
+// DefaultPointsSaveInterval is how often a running LocalPointsStore saves its changes, if its SaveInterval is 0
+const DefaultPointsSaveInterval = 5 * time.Second
+
+// ErrInsufficientPoints is given when deducting more points than a viewer has
+var ErrInsufficientPoints = errors.New("not enough points")
+
+// Account is a viewer's loyalty points balance
+type Account struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	Points   int64  `json:"points"`
+}
+
+// PointsStore keeps loyalty point balances
+// Changes tied to an event ID are applied at most once, so events seen again after a restart or reconnect are not counted twice
+type PointsStore interface {
+	// Apply changes a viewer's balance, creating their account if needed
+	// applied is false if the event ID was seen before, an empty event ID is never deduplicated
+	// Returns ErrInsufficientPoints if the balance would go below zero
+	Apply(userID, username string, delta int64, eventID string) (account Account, applied bool, err error)
+	// Account gives a viewer's balance, ok is false if they have none
+	Account(userID string) (account Account, ok bool, err error)
+	// Lookup finds an account by username, ignoring case
+	Lookup(username string) (account Account, ok bool, err error)
+	// Top gives the n accounts with the most points, highest first
+	Top(n int) ([]Account, error)
+}
+
+// LocalPointsStore keeps balances in memory, optionally saving them to a JSON file
+// Changes are batched rather than saved one at a time, Run saves them periodically and Flush saves them straight away
+// Balances and seen event IDs are saved together, so events lost in a crash are counted again when they are replayed
+type LocalPointsStore struct {
+	SaveInterval time.Duration // How often Run saves changes, DefaultPointsSaveInterval if 0
+	Logger       api.Logger    // Where failed saves are reported, silent if nil
+
+	mu       sync.Mutex
+	path     string
+	accounts map[string]*Account
+	seen     *recentIDs
+	dirty    bool // If there are changes that haven't been saved
+}
+
+// localPointsFile is how a LocalPointsStore is saved
+type localPointsFile struct {
+	Accounts []Account `json:"accounts"`
+	Seen     []string  `json:"seen"`
+}
+
+// NewLocalPointsStore creates a store saved to the file at path, loading it if it exists
+// An empty path keeps balances in memory only
+func NewLocalPointsStore(path string) (*LocalPointsStore, error) {
+	s := &LocalPointsStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+		seen:     newRecentIDs(seenEventLimit),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var f localPointsFile
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	for i := range f.Accounts {
+		a := f.Accounts[i]
+		s.accounts[a.UserID] = &a
+	}
+
+	for _, id := range f.Seen {
+		s.seen.add(id)
+	}
+
+	return s, nil
+}
+
+func (s *LocalPointsStore) Apply(userID, username string, delta int64, eventID string) (Account, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[userID]
+
+	if eventID != "" && s.seen.has(eventID) {
+		if !ok {
+			return Account{UserID: userID, Username: username}, false, nil
+		}
+
+		return *a, false, nil
+	}
+
+	if !ok {
+		a = &Account{UserID: userID}
+	}
+
+	if a.Points+delta < 0 {
+		return *a, false, ErrInsufficientPoints
+	}
+
+	a.Points += delta
+
+	if username != "" {
+		a.Username = username
+	}
+
+	s.accounts[userID] = a
+
+	if eventID != "" {
+		s.seen.add(eventID)
+	}
+
+	s.dirty = true
+
+	return *a, true, nil
+}
+
+func (s *LocalPointsStore) Account(userID string) (Account, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[userID]
+
+	if !ok {
+		return Account{}, false, nil
+	}
+
+	return *a, true, nil
+}
+
+func (s *LocalPointsStore) Lookup(username string) (Account, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	username = strings.TrimPrefix(username, "@")
+
+	for _, a := range s.accounts {
+		if strings.EqualFold(a.Username, username) {
+			return *a, true, nil
+		}
+	}
+
+	return Account{}, false, nil
+}
+
+func (s *LocalPointsStore) Top(n int) ([]Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]Account, 0, len(s.accounts))
+
+	for _, a := range s.accounts {
+		accounts = append(accounts, *a)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Points != accounts[j].Points {
+			return accounts[i].Points > accounts[j].Points
+		}
+
+		return accounts[i].Username < accounts[j].Username
+	})
+
+	if n >= 0 && n < len(accounts) {
+		accounts = accounts[:n]
+	}
+
+	return accounts, nil
+}
+
+// Flush saves any changes that haven't been saved yet
+func (s *LocalPointsStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	if err := s.save(); err != nil {
+		return err
+	}
+
+	s.dirty = false
+
+	return nil
+}
+
+// Run saves changes every SaveInterval until the context is done, then saves any left
+// Failed saves are reported to the Logger and tried again next time
+func (s *LocalPointsStore) Run(ctx context.Context) error {
+	interval := s.SaveInterval
+
+	if interval <= 0 {
+		interval = DefaultPointsSaveInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				return err
+			}
+
+			return ctx.Err()
+		case <-t.C:
+			if err := s.Flush(); err != nil {
+				logger(s.Logger).Warn("unable to save points", "path", s.path, "error", err)
+			}
+		}
+	}
+}
+
+// save writes the store to its file, the lock must be held
+func (s *LocalPointsStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	f := localPointsFile{
+		Accounts: make([]Account, 0, len(s.accounts)),
+		Seen:     s.seen.order,
+	}
+
+	for _, a := range s.accounts {
+		f.Accounts = append(f.Accounts, *a)
+	}
+
+	b, err := json.Marshal(f)
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, b)
+}
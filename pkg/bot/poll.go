@@ -0,0 +1,348 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// pollTickInterval is how often a running Polls checks if the poll has ended or interim results are due
+const pollTickInterval = time.Second
+
+// Errors given by Polls used in the wrong state
+var (
+	ErrPollOpen = errors.New("a poll is already open")
+	ErrNoPoll   = errors.New("no poll is open")
+)
+
+// PollOption is a choice in a poll, and how many votes it has
+type PollOption struct {
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+// PollResult is a snapshot of a poll's tally
+type PollResult struct {
+	Question string       `json:"question"`
+	Options  []PollOption `json:"options"`
+	Total    int          `json:"total"`
+	Open     bool         `json:"open"` // False once the poll has ended
+	StartsAt time.Time    `json:"startsAt"`
+	EndsAt   time.Time    `json:"endsAt"`
+}
+
+// Winners gives the options with the most votes, more than one if there is a tie
+func (r PollResult) Winners() []PollOption {
+	var winners []PollOption
+
+	for _, o := range r.Options {
+		switch {
+		case len(winners) == 0 || o.Votes > winners[0].Votes:
+			winners = []PollOption{o}
+		case o.Votes == winners[0].Votes:
+			winners = append(winners, o)
+		}
+	}
+
+	return winners
+}
+
+// String gives the tally as a single chat line
+func (r PollResult) String() string {
+	parts := make([]string, len(r.Options))
+
+	for i, o := range r.Options {
+		percent := 0
+
+		if r.Total > 0 {
+			percent = o.Votes * 100 / r.Total
+		}
+
+		parts[i] = fmt.Sprintf("%d) %s: %d (%d%%)", i+1, o.Text, o.Votes, percent)
+	}
+
+	return r.Question + " " + strings.Join(parts, ", ")
+}
+
+// Polls runs one chat poll at a time
+// Chatters vote by sending an option's number or text, or using the !vote command, and only their first vote counts
+type Polls struct {
+	Chat            Chat
+	InterimInterval time.Duration // How often results are posted while a poll is open, 0 to only post final results
+	OnUpdate        func(r PollResult)
+	Logger          api.Logger // Where failures to post results are reported, silent if nil
+
+	mu          sync.Mutex
+	result      PollResult
+	voted       map[string]bool // Chatters who have voted, by user ID
+	lastInterim time.Time
+	now         func() time.Time
+}
+
+// NewPolls creates a Polls that posts results in the given chat
+func NewPolls(chat Chat) *Polls {
+	return &Polls{
+		Chat: chat,
+		now:  time.Now,
+	}
+}
+
+// Start opens a poll for the given duration, announcing it in chat
+func (p *Polls) Start(question string, options []string, duration time.Duration) error {
+	if len(options) < 2 {
+		return errors.New("a poll needs at least 2 options")
+	}
+
+	if duration <= 0 {
+		return errors.New("a poll needs a duration")
+	}
+
+	p.mu.Lock()
+
+	if p.result.Open {
+		p.mu.Unlock()
+		return ErrPollOpen
+	}
+
+	now := p.now()
+
+	p.result = PollResult{
+		Question: question,
+		Options:  make([]PollOption, len(options)),
+		Open:     true,
+		StartsAt: now,
+		EndsAt:   now.Add(duration),
+	}
+
+	for i, o := range options {
+		p.result.Options[i].Text = o
+	}
+
+	p.voted = make(map[string]bool)
+	p.lastInterim = now
+
+	r := p.snapshot()
+	p.mu.Unlock()
+
+	p.updated(r)
+
+	choices := make([]string, len(options))
+
+	for i, o := range options {
+		choices[i] = fmt.Sprintf("%d) %s", i+1, o)
+	}
+
+	return p.Chat.Say(fmt.Sprintf("Poll: %s %s (vote with a number, closes in %s)", question, strings.Join(choices, ", "), duration))
+}
+
+// End closes the poll, posting the final results
+func (p *Polls) End() (PollResult, error) {
+	p.mu.Lock()
+
+	if !p.result.Open {
+		p.mu.Unlock()
+		return PollResult{}, ErrNoPoll
+	}
+
+	p.result.Open = false
+	p.result.EndsAt = p.now()
+
+	r := p.snapshot()
+	p.mu.Unlock()
+
+	p.updated(r)
+
+	message := "Poll closed! " + r.String()
+
+	if winners := r.Winners(); r.Total > 0 && len(winners) == 1 {
+		message += " Winner: " + winners[0].Text
+	}
+
+	return r, p.Chat.Say(message)
+}
+
+// Results gives the current tally of the open poll, or the final tally of the last one
+// ok is false if no poll has been run
+func (p *Polls) Results() (r PollResult, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snapshot(), !p.result.StartsAt.IsZero()
+}
+
+// HandleMessage counts a chat message as a vote if it names an option of the open poll
+func (p *Polls) HandleMessage(m api.StreamMessage) {
+	if m.Type != api.MessageTypeText {
+		return
+	}
+
+	p.vote(m, m.Content)
+}
+
+// Run ends the poll once its time is up and posts interim results, until the context is done
+func (p *Polls) Run(ctx context.Context) error {
+	t := time.NewTicker(pollTickInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			p.tick()
+		}
+	}
+}
+
+// Register adds the poll commands to the router
+// Moderators can use !poll <duration> "question" "option" "option"... and !endpoll, everyone can use !vote <option>
+func (p *Polls) Register(r *Router) error {
+	commands := []Command{
+		{
+			Name:        "poll",
+			Description: "Starts a poll",
+			Permission:  PermissionModerator,
+			Handler:     p.startCommand,
+		},
+		{
+			Name:        "endpoll",
+			Description: "Ends the poll early",
+			Permission:  PermissionModerator,
+			Handler: func(c *CommandContext) error {
+				if _, err := p.End(); err == ErrNoPoll {
+					return c.Reply(err.Error())
+				} else if err != nil {
+					return err
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:        "vote",
+			Description: "Votes in the poll",
+			Handler: func(c *CommandContext) error {
+				p.vote(c.Message, c.RawArgs())
+				return nil
+			},
+		},
+	}
+
+	for _, c := range commands {
+		if err := r.Handle(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Polls) startCommand(c *CommandContext) error {
+	duration, err := time.ParseDuration(c.Arg(0))
+
+	if err != nil || len(c.Args) < 4 {
+		return c.Reply(`Usage: poll <duration> "question" "option" "option"...`)
+	}
+
+	err = p.Start(c.Args[1], c.Args[2:], duration)
+
+	if err == ErrPollOpen {
+		return c.Reply(err.Error())
+	}
+
+	return err
+}
+
+// vote counts the choice for the sender if it names an option and they haven't voted yet
+func (p *Polls) vote(m api.StreamMessage, choice string) {
+	choice = strings.TrimSpace(choice)
+
+	p.mu.Lock()
+
+	if !p.result.Open || p.voted[m.Sender.ID] || !p.now().Before(p.result.EndsAt) {
+		p.mu.Unlock()
+		return
+	}
+
+	option := -1
+
+	if n, err := strconv.Atoi(choice); err == nil && n >= 1 && n <= len(p.result.Options) {
+		option = n - 1
+	} else {
+		for i, o := range p.result.Options {
+			if strings.EqualFold(choice, o.Text) {
+				option = i
+				break
+			}
+		}
+	}
+
+	if option < 0 {
+		p.mu.Unlock()
+		return
+	}
+
+	p.voted[m.Sender.ID] = true
+	p.result.Options[option].Votes++
+	p.result.Total++
+
+	r := p.snapshot()
+	p.mu.Unlock()
+
+	p.updated(r)
+}
+
+// tick ends the poll if its time is up, or posts interim results if they are due
+func (p *Polls) tick() {
+	p.mu.Lock()
+
+	if !p.result.Open {
+		p.mu.Unlock()
+		return
+	}
+
+	now := p.now()
+
+	if !now.Before(p.result.EndsAt) {
+		p.mu.Unlock()
+
+		if _, err := p.End(); err != nil && err != ErrNoPoll {
+			logger(p.Logger).Warn("unable to post poll results", "error", err)
+		}
+
+		return
+	}
+
+	if p.InterimInterval <= 0 || now.Sub(p.lastInterim) < p.InterimInterval {
+		p.mu.Unlock()
+		return
+	}
+
+	p.lastInterim = now
+	r := p.snapshot()
+	p.mu.Unlock()
+
+	if err := p.Chat.Say("Poll results so far: " + r.String()); err != nil {
+		logger(p.Logger).Warn("unable to post poll results", "error", err)
+	}
+}
+
+// snapshot copies the tally, the lock must be held
+func (p *Polls) snapshot() PollResult {
+	r := p.result
+	r.Options = append([]PollOption(nil), p.result.Options...)
+
+	return r
+}
+
+func (p *Polls) updated(r PollResult) {
+	if p.OnUpdate != nil {
+		p.OnUpdate(r)
+	}
+}
@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestPolls(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+
+	r := newTestRouter(sender, clock)
+
+	p := NewPolls(Chat{Sender: sender})
+	p.now = clock.Now
+
+	if err := p.Register(r); err != nil {
+		t.Fatalf("failed to register poll commands: %s", err)
+	}
+
+	moderator := chatMessage("1", "mod", `!poll 1m "Best fruit?" "Lemon" "Ice Cream" "2"`)
+	moderator.RoomRole = api.RoomRoleModerator
+
+	r.HandleMessage(moderator)
+
+	if _, ok := p.Results(); !ok {
+		t.Fatal("expected the poll to be started by the command")
+	}
+
+	if err := p.Start("Again?", []string{"yes", "no"}, time.Minute); err != ErrPollOpen {
+		t.Errorf("expected a second poll to be refused, got %v", err)
+	}
+
+	for _, m := range []api.StreamMessage{
+		chatMessage("2", "alice", "1"),          // By number
+		chatMessage("2", "alice", "2"),          // Only the first vote counts
+		chatMessage("3", "bob", " ice cream "),  // By text, ignoring case and spaces
+		chatMessage("4", "carol", "4"),          // Not an option
+		chatMessage("4", "carol", "lemons"),     // Not an option
+		chatMessage("5", "dave", "!vote Lemon"), // Through the command
+		chatMessage("6", "erin", "2"),           // A number is an option's position, even if another option's text is a number
+	} {
+		if !r.HandleMessage(m) {
+			p.HandleMessage(m)
+		}
+	}
+
+	results, _ := p.Results()
+
+	if results.Total != 4 || results.Options[0].Votes != 2 || results.Options[1].Votes != 2 || results.Options[2].Votes != 0 {
+		t.Errorf("expected 2 votes for Lemon, 2 for Ice Cream, and none for 2, got %+v", results.Options)
+	}
+
+	if winners := results.Winners(); len(winners) != 2 {
+		t.Errorf("expected a tie, got %+v", winners)
+	}
+
+	p.HandleMessage(chatMessage("4", "carol", "lemon"))
+	clock.Advance(time.Minute)
+
+	// Votes after the poll's time is up aren't counted, even before it is closed
+	p.HandleMessage(chatMessage("7", "frank", "lemon"))
+	p.tick()
+
+	final, _ := p.Results()
+
+	if final.Open || final.Total != 5 || final.Options[0].Votes != 3 {
+		t.Errorf("expected the poll closed with Lemon on 3 of 5 votes, got %+v", final)
+	}
+
+	sent := sender.messages()
+
+	if last := sent[len(sent)-1]; !strings.HasPrefix(last, "Poll closed!") || !strings.HasSuffix(last, "Winner: Lemon") {
+		t.Errorf("expected the final results announced, got %q", last)
+	}
+
+	if want := "Best fruit? 1) Lemon: 3 (60%), 2) Ice Cream: 2 (40%), 3) 2: 0 (0%)"; final.String() != want {
+		t.Errorf("expected tally %q, got %q", want, final.String())
+	}
+
+	p.HandleMessage(chatMessage("8", "grace", "lemon"))
+
+	if after, _ := p.Results(); after.Total != 5 {
+		t.Errorf("expected no votes counted once closed, got %d", after.Total)
+	}
+
+	if _, err := p.End(); err != ErrNoPoll {
+		t.Errorf("expected ending a closed poll to fail, got %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+package bot
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultMaxMessageLength is the longest chat message a ChatQueue sends before splitting it, in characters
+const DefaultMaxMessageLength = 140
+
+// DefaultSendInterval is the least time a ChatQueue leaves between messages when slow mode is off
+const DefaultSendInterval = time.Second
+
+// Errors given for messages a ChatQueue won't send
+var (
+	ErrEmptyMessage = errors.New("message is empty")
+	ErrQueueStopped = errors.New("chat queue has stopped")
+)
+
+// Priority orders messages waiting in a ChatQueue, higher priorities are sent first
+type Priority int
+
+const (
+	PriorityLow    Priority = iota // Announcements and other messages that can wait
+	PriorityNormal                 // Command replies and alerts
+	PriorityHigh                   // Moderation notices
+)
+
+// SendResult is the outcome of sending a queued message
+// A message split into parts gives the response to its last part, or the error of the first part that failed
+type SendResult struct {
+	Response api.Response
+	Err      error
+}
+
+// queuedMessage is a message waiting in a ChatQueue
+type queuedMessage struct {
+	key      string // Streamer and message, used to find identical messages
+	args     api.SendStreamChatMessageArgs
+	parts    []string
+	priority Priority
+	seq      uint64 // Order the message was queued in, so messages of the same priority are sent in order
+	results  []chan SendResult
+}
+
+// messageHeap orders queued messages by priority, then by when they were queued
+type messageHeap []*queuedMessage
+
+func (h messageHeap) Len() int { return len(h) }
+
+func (h messageHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h messageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *messageHeap) Push(x interface{}) { *h = append(*h, x.(*queuedMessage)) }
+func (h *messageHeap) Pop() (x interface{}) {
+	old := *h
+	x = old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// ChatQueue paces messages sent to chat so they aren't refused for breaking slow mode
+// Messages are sent highest priority first, identical messages waiting to be sent are only sent once, and long ones are split
+// A ChatQueue is a ChatSender, so a Chat can send through it, see WithPriority for sending at other priorities
+type ChatQueue struct {
+	Sender    ChatSender // Used to send messages
+	MaxLength int        // Longest message sent before splitting, DefaultMaxMessageLength if 0
+	Logger    api.Logger // Where failed sends are reported, silent if nil
+
+	mu       sync.Mutex
+	interval time.Duration
+	messages messageHeap
+	pending  map[string]*queuedMessage // Messages waiting to be sent, by key
+	seq      uint64
+	wake     chan struct{}
+	done     chan struct{} // Closed once Run has returned
+}
+
+// NewChatQueue creates a ChatQueue that sends with the given sender
+func NewChatQueue(sender ChatSender) *ChatQueue {
+	return &ChatQueue{
+		Sender:   sender,
+		interval: DefaultSendInterval,
+		pending:  make(map[string]*queuedMessage),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetSlowMode sets the least time left between messages to the room's chat interval, see ChatInterval
+// Intervals shorter than DefaultSendInterval are raised to it
+func (q *ChatQueue) SetSlowMode(interval time.Duration) {
+	if interval < DefaultSendInterval {
+		interval = DefaultSendInterval
+	}
+
+	q.mu.Lock()
+	q.interval = interval
+	q.mu.Unlock()
+}
+
+// Enqueue adds a message to the queue, the result is given on the channel once it is sent
+// If an identical message to the same streamer is already waiting, the two are sent once and share the result
+// Empty messages, and messages queued after Run has returned, are given an error straight away
+func (q *ChatQueue) Enqueue(args api.SendStreamChatMessageArgs, priority Priority) <-chan SendResult {
+	result := make(chan SendResult, 1)
+	key := args.Input.Streamer + "\x00" + args.Input.Message
+
+	if strings.TrimSpace(args.Input.Message) == "" {
+		result <- SendResult{Err: ErrEmptyMessage}
+		return result
+	}
+
+	q.mu.Lock()
+
+	if q.stopped() {
+		q.mu.Unlock()
+		result <- SendResult{Err: ErrQueueStopped}
+		return result
+	}
+
+	if m, ok := q.pending[key]; ok {
+		m.results = append(m.results, result)
+
+		// Send it at the most urgent priority it was asked for
+		if priority > m.priority {
+			m.priority = priority
+			heap.Init(&q.messages)
+		}
+
+		q.mu.Unlock()
+
+		return result
+	}
+
+	q.seq++
+
+	m := &queuedMessage{
+		key:      key,
+		args:     args,
+		parts:    splitMessage(args.Input.Message, q.maxLength()),
+		priority: priority,
+		seq:      q.seq,
+		results:  []chan SendResult{result},
+	}
+
+	if q.pending == nil {
+		q.pending = make(map[string]*queuedMessage)
+	}
+
+	q.pending[key] = m
+	heap.Push(&q.messages, m)
+	q.mu.Unlock()
+
+	q.signal()
+
+	return result
+}
+
+// SendStreamChat queues a message at normal priority and waits for it to be sent
+// It blocks until Run sends the message, or returns
+func (q *ChatQueue) SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error) {
+	r := <-q.Enqueue(args, PriorityNormal)
+
+	return r.Response, r.Err
+}
+
+// WithPriority gives a ChatSender that queues messages at the given priority and waits for them to be sent
+func (q *ChatQueue) WithPriority(priority Priority) ChatSender {
+	return prioritySender{queue: q, priority: priority}
+}
+
+// Len gives how many messages are waiting to be sent
+func (q *ChatQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages)
+}
+
+// Run sends queued messages, leaving the slow mode interval between each one, until the context is done
+// Messages still waiting when the context is done are given its error, and the queue can't be used again
+func (q *ChatQueue) Run(ctx context.Context) error {
+	q.mu.Lock()
+	stopped := q.stopped()
+	q.mu.Unlock()
+
+	if stopped {
+		return ErrQueueStopped
+	}
+
+	var last time.Time
+
+	for {
+		m := q.next()
+
+		if m == nil {
+			select {
+			case <-ctx.Done():
+				q.stop(ctx.Err())
+				return ctx.Err()
+			case <-q.wake:
+				continue
+			}
+		}
+
+		var result SendResult
+
+		for _, part := range m.parts {
+			if err := q.pace(ctx, last); err != nil {
+				q.finish(m, SendResult{Err: err})
+				q.stop(err)
+				return err
+			}
+
+			args := m.args
+			args.Input.Message = part
+
+			result.Response, result.Err = q.Sender.SendStreamChat(args)
+			last = time.Now()
+
+			if result.Err == nil {
+				result.Err = result.Response.MutationError(sendStreamChatField)
+			}
+
+			if result.Err != nil {
+				logger(q.Logger).Warn("unable to send queued message", "streamer", args.Input.Streamer, "error", result.Err)
+				break
+			}
+		}
+
+		q.finish(m, result)
+	}
+}
+
+// next takes the most urgent message off the queue, nil if it is empty
+// The message stays pending, so identical messages queued while it is sent share its result
+func (q *ChatQueue) next() *queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return nil
+	}
+
+	return heap.Pop(&q.messages).(*queuedMessage)
+}
+
+// finish gives the result to everyone waiting on the message
+func (q *ChatQueue) finish(m *queuedMessage, r SendResult) {
+	q.mu.Lock()
+
+	if q.pending[m.key] == m {
+		delete(q.pending, m.key)
+	}
+
+	results := m.results
+	q.mu.Unlock()
+
+	for _, c := range results {
+		c <- r
+	}
+}
+
+// stop refuses any more messages, then gives the error to every message still waiting
+func (q *ChatQueue) stop(err error) {
+	q.mu.Lock()
+	if q.done == nil {
+		q.done = make(chan struct{})
+	}
+	if !q.stopped() {
+		close(q.done)
+	}
+	q.mu.Unlock()
+
+	for m := q.next(); m != nil; m = q.next() {
+		q.finish(m, SendResult{Err: err})
+	}
+}
+
+// stopped reports if Run has returned, the lock must be held
+func (q *ChatQueue) stopped() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// pace waits until the interval has passed since the last message was sent
+func (q *ChatQueue) pace(ctx context.Context, last time.Time) error {
+	q.mu.Lock()
+	wait := q.interval - time.Since(last)
+	q.mu.Unlock()
+
+	if last.IsZero() || wait <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (q *ChatQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *ChatQueue) maxLength() int {
+	if q.MaxLength <= 0 {
+		return DefaultMaxMessageLength
+	}
+
+	return q.MaxLength
+}
+
+// prioritySender sends through a ChatQueue at a fixed priority
+type prioritySender struct {
+	queue    *ChatQueue
+	priority Priority
+}
+
+func (s prioritySender) SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error) {
+	r := <-s.queue.Enqueue(args, s.priority)
+
+	return r.Response, r.Err
+}
+
+// splitMessage breaks a message into parts of at most max characters, between words where possible
+func splitMessage(message string, max int) []string {
+	var parts []string
+
+	message = strings.TrimSpace(message)
+
+	for utf8.RuneCountInString(message) > max {
+		// Byte offset of the first character past the limit
+		cut := len(message)
+		n := 0
+
+		for i := range message {
+			if n == max {
+				cut = i
+				break
+			}
+			n++
+		}
+
+		// Break at the last space before the limit, unless that leaves the part empty
+		if space := strings.LastIndexByte(message[:cut+1], ' '); space > 0 {
+			cut = space
+		}
+
+		parts = append(parts, strings.TrimSpace(message[:cut]))
+		message = strings.TrimSpace(message[cut:])
+	}
+
+	return append(parts, message)
+}
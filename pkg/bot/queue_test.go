@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// timedSender records when each message is sent
+type timedSender struct {
+	fakeSender
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (s *timedSender) SendStreamChat(args api.SendStreamChatMessageArgs) (api.Response, error) {
+	s.mu.Lock()
+	s.times = append(s.times, time.Now())
+	s.mu.Unlock()
+
+	return s.fakeSender.SendStreamChat(args)
+}
+
+func queueArgs(message string) api.SendStreamChatMessageArgs {
+	return api.SendStreamChatMessageArgs{Input: api.SendStreamChatMessageInput{Message: message, Streamer: "streamer"}}
+}
+
+func TestChatQueue(t *testing.T) {
+	sender := &timedSender{}
+
+	q := NewChatQueue(sender)
+	q.MaxLength = 10
+	q.interval = 50 * time.Millisecond
+
+	// Queued before Run starts, so the order is only decided by priority
+	low := q.Enqueue(queueArgs("later"), PriorityLow)
+	normal := q.Enqueue(queueArgs("hello"), PriorityNormal)
+	again := q.Enqueue(queueArgs("hello"), PriorityNormal)
+	high := q.Enqueue(queueArgs("stop spamming please"), PriorityHigh)
+
+	if r := <-q.Enqueue(queueArgs("  "), PriorityHigh); r.Err != ErrEmptyMessage {
+		t.Errorf("expected an empty message refused, got %v", r.Err)
+	}
+
+	if q.Len() != 3 {
+		t.Errorf("expected the identical message queued once, have %d", q.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- q.Run(ctx) }()
+
+	for _, c := range []<-chan SendResult{low, normal, again, high} {
+		if r := <-c; r.Err != nil {
+			t.Errorf("expected the message sent, got %v", r.Err)
+		}
+	}
+
+	want := []string{"stop", "spamming", "please", "hello", "later"}
+
+	if got := sender.messages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	for i := 1; i < len(sender.times); i++ {
+		if gap := sender.times[i].Sub(sender.times[i-1]); gap < q.interval {
+			t.Errorf("expected at least %s between messages, message %d came after %s", q.interval, i, gap)
+		}
+	}
+
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected Run to end with the context's error, got %v", err)
+	}
+
+	// Nothing would send it, so it must not wait forever
+	if _, err := q.WithPriority(PriorityHigh).SendStreamChat(queueArgs("too late")); err != ErrQueueStopped {
+		t.Errorf("expected a stopped queue to refuse messages, got %v", err)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		max     int
+		want    []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"split between words", 10, []string{"split", "between", "words"}},
+		{"abcdefghijkl", 5, []string{"abcde", "fghij", "kl"}},
+		{"héllo wörld", 5, []string{"héllo", "wörld"}},
+		{"  padded  ", 10, []string{"padded"}},
+	} {
+		if got := splitMessage(test.message, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("split %q at %d: expected %q, got %q", test.message, test.max, test.want, got)
+		}
+
+		for _, part := range splitMessage(test.message, test.max) {
+			if n := len([]rune(part)); n > test.max || strings.TrimSpace(part) != part {
+				t.Errorf("split %q at %d: part %q is too long or padded", test.message, test.max, part)
+			}
+		}
+	}
+}
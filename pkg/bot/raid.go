@@ -0,0 +1,354 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultRaidWindow is how far back a RaidDetector looks when counting events, if its Window is 0
+const DefaultRaidWindow = 30 * time.Second
+
+// DefaultRaidCalmPeriod is how long a RaidDetector waits without a threshold being crossed before lifting a lockdown, if its CalmPeriod is 0
+const DefaultRaidCalmPeriod = 2 * time.Minute
+
+// raidCheckInterval is how often a running RaidDetector checks if things have calmed down
+const raidCheckInterval = 5 * time.Second
+
+// raidSeenLimit is how many chatters a RaidDetector remembers when deciding who is new, and how many event IDs it remembers
+const raidSeenLimit = 10000
+
+// Why a RaidDetector raised an alert
+const (
+	RaidReasonFollows     = "follows"      // Too many follows within the window
+	RaidReasonMessages    = "messages"     // Too many chat messages within the window
+	RaidReasonNewChatters = "new_chatters" // Too large a share of the chatters within the window are new
+)
+
+// ChatIntervalClient changes the slow mode setting of the authorized user's chat, an *api.Client satisfies it
+type ChatIntervalClient interface {
+	SetChatInterval(args api.SetChatIntervalArgs) (api.Response, error)
+}
+
+// RaidAlert describes the burst of activity that made a RaidDetector raise an alert
+type RaidAlert struct {
+	Time        time.Time
+	Reasons     []string // The RaidReason constants for each threshold crossed
+	Follows     int      // Follows within the window
+	Messages    int      // Chat messages within the window
+	Chatters    int      // Different users who sent chat messages within the window
+	NewChatters int      // Chatters within the window who hadn't been seen before
+	Locked      bool     // If the chat interval was raised, false if it was already at least LockdownInterval
+}
+
+// String describes the alert, such as "follows (25 follows, 40 messages, 12/15 new chatters)"
+func (a RaidAlert) String() string {
+	return fmt.Sprintf("%s (%d follows, %d messages, %d/%d new chatters)", strings.Join(a.Reasons, ", "), a.Follows, a.Messages, a.NewChatters, a.Chatters)
+}
+
+// raidMessage is a chat message counted by a RaidDetector
+type raidMessage struct {
+	at     time.Time
+	sender string // User ID of who sent it
+	isNew  bool   // If it was the sender's first message seen
+}
+
+// RaidDetector watches a streamer's chat for bursts of follows and messages from new chatters, such as follow bots or spam raids
+// When a threshold is crossed it raises an alert, and if it has a Client, raises the chat interval until things calm down
+// The chat interval can only be changed for the authorized user's own chat
+type RaidDetector struct {
+	Client           ChatIntervalClient // Used to lock chat down, alerts are only raised if nil
+	Chat             *Chat              // Where AlertMessage is posted, nil to not post it
+	Self             string             // The bot account's username, its own messages aren't counted
+	Window           time.Duration      // How far back events are counted, DefaultRaidWindow if 0
+	MaxFollows       int                // Follows within the window that raise an alert, 0 to ignore follows
+	MaxMessages      int                // Chat messages within the window that raise an alert, 0 to ignore message rate
+	MaxNewRatio      float64            // Share of chatters within the window who are new that raises an alert, 0 to ignore new chatters
+	MinChatters      int                // Chatters needed within the window before MaxNewRatio applies
+	Info             ChatRoomInfoClient // Used to look up the chat interval before locking down, so it can be restored
+	Streamer         string             // Display name of the streamer, used with Info
+	LockdownInterval time.Duration      // Chat interval set while locked down, left alone if chat is already slower
+	NormalInterval   time.Duration      // Chat interval restored once things calm down, if Info is nil or the lookup fails
+	CalmPeriod       time.Duration      // How long without a threshold being crossed before the lockdown is lifted, DefaultRaidCalmPeriod if 0
+	AlertMessage     string             // Posted in chat when an alert is raised, not posted if empty
+	OnAlert          func(a RaidAlert)  // Called when an alert is raised, if set
+	Logger           api.Logger         // Where alerts and failed lockdowns are reported, silent if nil
+
+	mu          sync.Mutex
+	follows     []time.Time
+	messages    []raidMessage
+	seen        *recentIDs    // Users seen chatting
+	events      *recentIDs    // Events counted, so replayed ones aren't counted again
+	started     time.Time     // When the first event was seen, new chatters aren't judged until a window after it
+	raiding     bool          // If an alert has been raised and things haven't calmed down yet
+	locked      bool          // If the chat interval was raised
+	previous    time.Duration // The chat interval before the lockdown, restored when it is lifted
+	lastTrigger time.Time     // When a threshold was last crossed
+	now         func() time.Time
+}
+
+// NewRaidDetector creates a RaidDetector that locks chat down with the client, which may be nil
+func NewRaidDetector(client ChatIntervalClient) *RaidDetector {
+	return &RaidDetector{
+		Client: client,
+		seen:   newRecentIDs(raidSeenLimit),
+		events: newRecentIDs(raidSeenLimit),
+		now:    time.Now,
+	}
+}
+
+// HandleMessage counts a chat event, raising an alert if it crosses a threshold
+// Events seen again, such as when a feed reconnects, are only counted once
+func (d *RaidDetector) HandleMessage(m api.StreamMessage) {
+	if sameUser(m, d.Self) || (m.Type != api.MessageTypeFollow && m.Type != api.MessageTypeText) {
+		return
+	}
+
+	d.mu.Lock()
+
+	if d.events == nil {
+		d.events = newRecentIDs(raidSeenLimit)
+	}
+
+	if m.ID != "" && !d.events.add(m.ID) {
+		d.mu.Unlock()
+		return
+	}
+
+	now := d.now()
+	window := d.window()
+
+	if d.started.IsZero() {
+		d.started = now
+	}
+
+	switch m.Type {
+	case api.MessageTypeFollow:
+		d.follows = append(d.follows, now)
+	case api.MessageTypeText:
+		// Moderators and the streamer aren't part of a raid
+		if PermissionOf(m) >= PermissionModerator || m.Sender.ID == "" {
+			d.mu.Unlock()
+			return
+		}
+
+		if d.seen == nil {
+			d.seen = newRecentIDs(raidSeenLimit)
+		}
+
+		d.messages = append(d.messages, raidMessage{at: now, sender: m.Sender.ID, isNew: d.seen.add(m.Sender.ID)})
+	}
+
+	d.follows = recent(d.follows, now, window)
+
+	i := 0
+
+	for i < len(d.messages) && now.Sub(d.messages[i].at) >= window {
+		i++
+	}
+
+	d.messages = d.messages[i:]
+
+	alert := d.check(now)
+
+	if len(alert.Reasons) == 0 {
+		d.mu.Unlock()
+		return
+	}
+
+	d.lastTrigger = now
+
+	if d.raiding {
+		d.mu.Unlock()
+		return
+	}
+
+	d.raiding = true
+	d.mu.Unlock()
+
+	d.raise(alert)
+}
+
+// Raiding reports if an alert has been raised and things haven't calmed down yet
+func (d *RaidDetector) Raiding() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.raiding
+}
+
+// Restore ends the current alert, putting the chat interval back to what it was before the lockdown if it was raised
+func (d *RaidDetector) Restore() error {
+	d.mu.Lock()
+	locked := d.locked
+	previous := d.previous
+	d.raiding = false
+	d.locked = false
+	d.mu.Unlock()
+
+	if !locked || d.Client == nil {
+		return nil
+	}
+
+	if err := d.setInterval(previous); err != nil {
+		// Try again on the next check
+		d.mu.Lock()
+		d.raiding = true
+		d.locked = true
+		d.mu.Unlock()
+
+		return err
+	}
+
+	logger(d.Logger).Info("raid lockdown lifted", "interval", previous)
+
+	return nil
+}
+
+// Run lifts the lockdown once no threshold has been crossed for the calm period, until the context is done
+func (d *RaidDetector) Run(ctx context.Context) error {
+	t := time.NewTicker(raidCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if !d.calm() {
+				continue
+			}
+
+			if err := d.Restore(); err != nil {
+				logger(d.Logger).Error("unable to lift raid lockdown", "error", err)
+			}
+		}
+	}
+}
+
+// check compares the counts within the window to the thresholds, the lock must be held
+func (d *RaidDetector) check(now time.Time) RaidAlert {
+	alert := RaidAlert{
+		Time:     now,
+		Follows:  len(d.follows),
+		Messages: len(d.messages),
+	}
+
+	chatters := make(map[string]bool)
+
+	for _, m := range d.messages {
+		chatters[m.sender] = chatters[m.sender] || m.isNew
+	}
+
+	alert.Chatters = len(chatters)
+
+	for _, isNew := range chatters {
+		if isNew {
+			alert.NewChatters++
+		}
+	}
+
+	if d.MaxFollows > 0 && alert.Follows >= d.MaxFollows {
+		alert.Reasons = append(alert.Reasons, RaidReasonFollows)
+	}
+
+	if d.MaxMessages > 0 && alert.Messages >= d.MaxMessages {
+		alert.Reasons = append(alert.Reasons, RaidReasonMessages)
+	}
+
+	// Everyone is new when the detector starts, so give it a window to learn who the regulars are
+	warm := now.Sub(d.started) >= d.window()
+
+	if d.MaxNewRatio > 0 && warm && alert.Chatters > 0 && alert.Chatters >= d.MinChatters {
+		if float64(alert.NewChatters)/float64(alert.Chatters) >= d.MaxNewRatio {
+			alert.Reasons = append(alert.Reasons, RaidReasonNewChatters)
+		}
+	}
+
+	return alert
+}
+
+// raise locks chat down and reports the alert
+func (d *RaidDetector) raise(alert RaidAlert) {
+	if d.Client != nil && d.LockdownInterval > 0 {
+		previous := d.interval()
+
+		if previous >= d.LockdownInterval {
+			// Chat is already slower than a lockdown would make it
+			logger(d.Logger).Info("chat interval already at or above lockdown", "interval", previous)
+		} else if err := d.setInterval(d.LockdownInterval); err != nil {
+			logger(d.Logger).Error("unable to lock chat down", "error", err)
+		} else {
+			alert.Locked = true
+
+			d.mu.Lock()
+			d.locked = true
+			d.previous = previous
+			d.mu.Unlock()
+		}
+	}
+
+	logger(d.Logger).Warn("possible raid detected", "reasons", alert.Reasons, "follows", alert.Follows, "messages", alert.Messages, "chatters", alert.Chatters, "newChatters", alert.NewChatters, "locked", alert.Locked)
+
+	if d.OnAlert != nil {
+		d.OnAlert(alert)
+	}
+
+	if d.Chat != nil && d.AlertMessage != "" {
+		if err := d.Chat.Say(d.AlertMessage); err != nil {
+			logger(d.Logger).Warn("unable to post raid alert", "error", err)
+		}
+	}
+}
+
+// calm reports if an alert was raised and no threshold has been crossed for the calm period
+func (d *RaidDetector) calm() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	period := d.CalmPeriod
+
+	if period <= 0 {
+		period = DefaultRaidCalmPeriod
+	}
+
+	return d.raiding && d.now().Sub(d.lastTrigger) >= period
+}
+
+// interval gives the chat interval in effect, NormalInterval if it can't be looked up
+func (d *RaidDetector) interval() time.Duration {
+	if d.Info == nil {
+		return d.NormalInterval
+	}
+
+	interval, err := ChatInterval(d.Info, d.Streamer)
+
+	if err != nil {
+		logger(d.Logger).Warn("unable to look up chat interval before lockdown", "streamer", d.Streamer, "error", err)
+		return d.NormalInterval
+	}
+
+	return interval
+}
+
+func (d *RaidDetector) setInterval(interval time.Duration) error {
+	resp, err := d.Client.SetChatInterval(api.SetChatIntervalArgs{Seconds: int(interval / time.Second)})
+
+	if err != nil {
+		return err
+	}
+
+	return resp.MutationError("chatIntervalSet")
+}
+
+func (d *RaidDetector) window() time.Duration {
+	if d.Window <= 0 {
+		return DefaultRaidWindow
+	}
+
+	return d.Window
+}
@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+type fakeIntervalClient struct {
+	set []int
+}
+
+func (f *fakeIntervalClient) SetChatInterval(args api.SetChatIntervalArgs) (api.Response, error) {
+	f.set = append(f.set, args.Seconds)
+	return api.Response{}, nil
+}
+
+func TestRaidDetector(t *testing.T) {
+	clock := newFakeClock()
+	client := &fakeIntervalClient{}
+	sender := &fakeSender{}
+
+	d := NewRaidDetector(client)
+	d.Chat = &Chat{Sender: sender, Streamer: "streamer"}
+	d.MaxFollows = 5
+	d.MaxNewRatio = 0.8
+	d.MinChatters = 3
+	d.LockdownInterval = 30 * time.Second
+	d.NormalInterval = 2 * time.Second
+	d.AlertMessage = "Chat is locked down for a moment"
+	d.now = clock.Now
+
+	var alerts []RaidAlert
+	d.OnAlert = func(a RaidAlert) { alerts = append(alerts, a) }
+
+	// Regulars, seen before new chatters are judged
+	for i := 0; i < 3; i++ {
+		d.HandleMessage(chatMessage(fmt.Sprint(i), fmt.Sprint("regular", i), "hi"))
+	}
+
+	clock.Advance(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		d.HandleMessage(chatMessage(fmt.Sprint(i), fmt.Sprint("regular", i), "still here"))
+	}
+
+	for i := 0; i < 4; i++ {
+		d.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, Sender: api.Sender{ID: fmt.Sprint("bot", i)}})
+	}
+
+	if d.Raiding() || len(alerts) != 0 {
+		t.Fatalf("expected no alert from regulars and a few follows, got %v", alerts)
+	}
+
+	d.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, Sender: api.Sender{ID: "bot4"}})
+
+	if len(alerts) != 1 || alerts[0].Reasons[0] != RaidReasonFollows || !alerts[0].Locked {
+		t.Fatalf("expected a follow alert with lockdown, got %v", alerts)
+	}
+
+	if len(client.set) != 1 || client.set[0] != 30 {
+		t.Errorf("expected chat interval set to 30, got %v", client.set)
+	}
+
+	if sent := sender.messages(); len(sent) != 1 {
+		t.Errorf("expected the alert message in chat, got %v", sent)
+	}
+
+	// Still raiding, so no second alert
+	d.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, Sender: api.Sender{ID: "bot5"}})
+
+	if len(alerts) != 1 {
+		t.Errorf("expected one alert while raiding, got %d", len(alerts))
+	}
+
+	clock.Advance(DefaultRaidCalmPeriod)
+
+	if !d.calm() {
+		t.Fatal("expected it to be calm after the calm period")
+	}
+
+	if err := d.Restore(); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+
+	if d.Raiding() || len(client.set) != 2 || client.set[1] != 2 {
+		t.Errorf("expected chat interval restored to 2, got %v", client.set)
+	}
+
+	// A wave of new accounts chatting
+	for i := 0; i < 3; i++ {
+		d.HandleMessage(chatMessage(fmt.Sprint("new", i), fmt.Sprint("spam", i), "buy followers"))
+	}
+
+	if len(alerts) != 2 || alerts[1].Reasons[0] != RaidReasonNewChatters || alerts[1].NewChatters != 3 {
+		t.Errorf("expected a new chatter alert, got %v", alerts)
+	}
+}
+
+// fakeChatRoomInfo serves a LivestreamChatRoomInfo response with a fixed chat interval
+type fakeChatRoomInfo struct {
+	seconds float64
+}
+
+func (f *fakeChatRoomInfo) LivestreamChatRoomInfo(args api.LivestreamChatRoomInfoArgs) (api.Response, error) {
+	return api.Response{Data: map[string]interface{}{
+		"userByDisplayName": map[string]interface{}{"chatInterval": f.seconds},
+	}}, nil
+}
+
+func TestRaidDetector_RestorePrevious(t *testing.T) {
+	clock := newFakeClock()
+	client := &fakeIntervalClient{}
+
+	d := NewRaidDetector(client)
+	d.Info = &fakeChatRoomInfo{seconds: 5}
+	d.Streamer = "streamer"
+	d.MaxFollows = 2
+	d.LockdownInterval = 30 * time.Second
+	d.NormalInterval = 2 * time.Second
+	d.now = clock.Now
+
+	follow := api.StreamMessage{Type: api.MessageTypeFollow, ID: "f1", Sender: api.Sender{ID: "bot1"}}
+
+	// A replayed follow isn't counted twice
+	d.HandleMessage(follow)
+	d.HandleMessage(follow)
+
+	if d.Raiding() {
+		t.Fatal("expected a replayed follow not to raise an alert")
+	}
+
+	d.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, ID: "f2", Sender: api.Sender{ID: "bot2"}})
+
+	if !d.Raiding() {
+		t.Fatal("expected two follows to raise an alert")
+	}
+
+	clock.Advance(DefaultRaidCalmPeriod)
+
+	if err := d.Restore(); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+
+	// The interval before the lockdown was 5 seconds, not NormalInterval
+	if len(client.set) != 2 || client.set[0] != 30 || client.set[1] != 5 {
+		t.Errorf("expected chat interval set to 30 then back to 5, got %v", client.set)
+	}
+}
+
+func TestRaidDetector_AlreadySlower(t *testing.T) {
+	clock := newFakeClock()
+	client := &fakeIntervalClient{}
+
+	d := NewRaidDetector(client)
+	d.MaxFollows = 1
+	d.LockdownInterval = 10 * time.Second
+	d.NormalInterval = time.Minute
+	d.now = clock.Now
+
+	var alerts []RaidAlert
+	d.OnAlert = func(a RaidAlert) { alerts = append(alerts, a) }
+
+	d.HandleMessage(api.StreamMessage{Type: api.MessageTypeFollow, ID: "f1", Sender: api.Sender{ID: "bot1"}})
+
+	if len(alerts) != 1 || alerts[0].Locked {
+		t.Fatalf("expected an alert without a lockdown, got %v", alerts)
+	}
+
+	clock.Advance(DefaultRaidCalmPeriod)
+
+	if err := d.Restore(); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+
+	// A lockdown would have loosened slow mode, and there is nothing to restore
+	if len(client.set) != 0 || d.Raiding() {
+		t.Errorf("expected the chat interval left alone, got %v", client.set)
+	}
+}
@@ -0,0 +1,281 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultRelayRateLimit is how many messages a Relay posts to a channel within its rate window, if its RateLimit is 0
+const DefaultRelayRateLimit = 10
+
+// DefaultRelayRateWindow is the window a Relay counts posted messages in, if its RateWindow is 0
+const DefaultRelayRateWindow = 30 * time.Second
+
+// relayEchoLimit is how many relayed messages a Relay remembers, to recognise them coming back
+const relayEchoLimit = 500
+
+// relayBuffer is how many messages wait to be posted by a Relay before more are dropped
+const relayBuffer = 100
+
+// relayPost is a relayed message waiting to be posted
+type relayPost struct {
+	from string
+	to   string
+	text string
+}
+
+// RelayFormat writes a relayed message, as [streamer] sender: message
+func RelayFormat(from string, m api.StreamMessage) string {
+	sender := m.Sender.Displayname
+
+	if sender == "" {
+		sender = m.Sender.Username
+	}
+
+	return fmt.Sprintf("[%s] %s: %s", from, sender, m.Content)
+}
+
+// Relay mirrors chat messages between streamers' chats, such as during a co-stream
+// Give it the events of an api.Aggregator that has joined every linked streamer
+// Messages sent by the bot account, and messages matching something it relayed, are never relayed, so they can't loop
+// Relayed messages are posted by Run from a goroutine of its own, so a slow Sender never holds up the events
+type Relay struct {
+	Sender       ChatSender                                    // Posts relayed messages, such as a ChatQueue
+	Self         string                                        // The bot account's username, its own messages are never relayed
+	RoomRole     string                                        // The bot account's role, used when posting
+	Format       func(from string, m api.StreamMessage) string // Writes relayed messages, RelayFormat if nil
+	Rules        []Rule                                        // Messages breaking any of these rules aren't relayed
+	SkipCommands string                                        // Messages starting with this, such as a command prefix, aren't relayed, if set
+	MaxLength    int                                           // Messages longer than this many characters aren't relayed, if set
+	RateLimit    int                                           // Messages posted to each channel within RateWindow, DefaultRelayRateLimit if 0
+	RateWindow   time.Duration                                 // DefaultRelayRateWindow if 0
+	Logger       api.Logger                                    // Where failed and dropped messages are reported, silent if nil
+
+	mu       sync.Mutex
+	links    map[string]map[string]bool // Where each streamer's messages are relayed to
+	echoes   *recentIDs                 // Messages relayed, by destination and text
+	limiters map[string]*rateLimitedSender
+	posts    chan relayPost
+	now      func() time.Time
+}
+
+// NewRelay creates a Relay mirroring the chat of each streamer to all of the others
+func NewRelay(sender ChatSender, streamers ...string) *Relay {
+	r := &Relay{
+		Sender:   sender,
+		links:    make(map[string]map[string]bool),
+		echoes:   newRecentIDs(relayEchoLimit),
+		limiters: make(map[string]*rateLimitedSender),
+		posts:    make(chan relayPost, relayBuffer),
+		now:      time.Now,
+	}
+
+	for _, from := range streamers {
+		for _, to := range streamers {
+			if from != to {
+				r.Link(from, to)
+			}
+		}
+	}
+
+	return r
+}
+
+// Link relays messages from one streamer's chat to another's
+func (r *Relay) Link(from string, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.links[from] == nil {
+		r.links[from] = make(map[string]bool)
+	}
+
+	r.links[from][to] = true
+}
+
+// Unlink stops relaying messages from one streamer's chat to another's
+func (r *Relay) Unlink(from string, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.links[from], to)
+}
+
+// HandleMessage queues a chat message to be posted by Run to the chats its streamer is linked to
+// It reports if the message was queued for any of them, messages are dropped if too many are waiting
+func (r *Relay) HandleMessage(m api.AggregatedMessage) bool {
+	if !r.relayable(m) {
+		return false
+	}
+
+	format := r.Format
+
+	if format == nil {
+		format = RelayFormat
+	}
+
+	text := format(m.Streamer, m.StreamMessage)
+
+	r.mu.Lock()
+
+	targets := make([]string, 0, len(r.links[m.Streamer]))
+
+	for to := range r.links[m.Streamer] {
+		targets = append(targets, to)
+	}
+
+	r.mu.Unlock()
+
+	queued := false
+
+	for _, to := range targets {
+		select {
+		case r.posts <- relayPost{from: m.Streamer, to: to, text: text}:
+			queued = true
+		default:
+			logger(r.Logger).Warn("relay is behind, dropped message", "from", m.Streamer, "to", to)
+		}
+	}
+
+	return queued
+}
+
+// Run relays the messages until the channel is closed or the context is done
+// Messages already queued are still posted once the channel is closed, but not once the context is done
+func (r *Relay) Run(ctx context.Context, messages <-chan api.AggregatedMessage) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		r.send(ctx, stop)
+	}()
+
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+
+			r.HandleMessage(m)
+		}
+	}
+}
+
+// send posts queued messages until the context is done, or until stop is closed and none are left
+func (r *Relay) send(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-r.posts:
+			r.post(p)
+		case <-stop:
+			for {
+				select {
+				case p := <-r.posts:
+					r.post(p)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// post sends a relayed message, remembering it once sent so it isn't relayed back
+func (r *Relay) post(p relayPost) {
+	resp, err := r.limiter(p.to).SendStreamChat(api.SendStreamChatMessageArgs{
+		Input: api.SendStreamChatMessageInput{
+			Message:  p.text,
+			RoomRole: r.RoomRole,
+			Streamer: p.to,
+		},
+	})
+
+	if err == nil {
+		err = resp.MutationError(sendStreamChatField)
+	}
+
+	if err != nil {
+		logger(r.Logger).Warn("unable to relay message", "from", p.from, "to", p.to, "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.echoes.add(p.to + "\x00" + p.text)
+	r.mu.Unlock()
+}
+
+// relayable reports if the message should be relayed at all
+func (r *Relay) relayable(m api.AggregatedMessage) bool {
+	if m.Type != api.MessageTypeText || sameUser(m.StreamMessage, r.Self) {
+		return false
+	}
+
+	content := strings.TrimSpace(m.Content)
+
+	if content == "" || (r.SkipCommands != "" && strings.HasPrefix(content, r.SkipCommands)) {
+		return false
+	}
+
+	if r.MaxLength > 0 && len([]rune(content)) > r.MaxLength {
+		return false
+	}
+
+	now := r.now()
+
+	for _, rule := range r.Rules {
+		if rule.Check(m.StreamMessage, now) {
+			return false
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Something relayed into this chat, posted by another account or seen back through another relay
+	return !r.echoes.has(m.Streamer + "\x00" + m.Content)
+}
+
+// limiter gives the rate limited sender for a streamer's chat
+func (r *Relay) limiter(streamer string) *rateLimitedSender {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l, ok := r.limiters[streamer]; ok {
+		return l
+	}
+
+	l := &rateLimitedSender{
+		sender: r.Sender,
+		limit:  r.RateLimit,
+		window: r.RateWindow,
+		now:    r.now,
+	}
+
+	if l.limit <= 0 {
+		l.limit = DefaultRelayRateLimit
+	}
+
+	if l.window <= 0 {
+		l.window = DefaultRelayRateWindow
+	}
+
+	r.limiters[streamer] = l
+
+	return l
+}
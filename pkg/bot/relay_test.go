@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// runRelay runs the relay until the returned func is called, which waits for everything queued to be posted
+func runRelay(t *testing.T, r *Relay) (chan<- api.AggregatedMessage, func()) {
+	messages := make(chan api.AggregatedMessage)
+	done := make(chan error)
+
+	go func() { done <- r.Run(context.Background(), messages) }()
+
+	return messages, func() {
+		close(messages)
+
+		if err := <-done; err != nil {
+			t.Errorf("expected the relay to stop cleanly, got %v", err)
+		}
+	}
+}
+
+// waitSent waits for the sender to have been asked to send n messages
+func waitSent(t *testing.T, sender *fakeSender, n int) {
+	deadline := time.Now().Add(time.Second)
+
+	for len(sender.messages()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages sent, got %q", n, sender.messages())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitEcho waits for the relay to remember posting the text to the streamer's chat
+func waitEcho(t *testing.T, r *Relay, to string, text string) {
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		r.mu.Lock()
+		ok := r.echoes.has(to + "\x00" + text)
+		r.mu.Unlock()
+
+		if ok {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q remembered as posted to %s", text, to)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	sender := &fakeSender{}
+
+	r := NewRelay(sender, "first", "second")
+	r.Self = "bot"
+	r.SkipCommands = "!"
+	r.MaxLength = 20
+	r.Link("third", "first")
+
+	messages, stop := runRelay(t, r)
+
+	for _, m := range []api.AggregatedMessage{
+		{Streamer: "first", StreamMessage: chatMessage("1", "alice", "hi")},
+		{Streamer: "first", StreamMessage: chatMessage("2", "bot", "from the bot")},
+		{Streamer: "first", StreamMessage: chatMessage("1", "alice", "!points")},
+		{Streamer: "first", StreamMessage: chatMessage("1", "alice", "this message is far too long")},
+		{Streamer: "first", StreamMessage: api.StreamMessage{Type: api.MessageTypeFollow, Sender: api.Sender{ID: "1", Username: "alice"}}},
+		{Streamer: "third", StreamMessage: chatMessage("3", "carol", "hello")},
+	} {
+		messages <- m
+	}
+
+	waitSent(t, sender, 2)
+	waitEcho(t, r, "second", "[first] alice: hi")
+
+	// Another relay posting what we relayed back into the chat it came from
+	messages <- api.AggregatedMessage{Streamer: "second", StreamMessage: chatMessage("4", "otherbot", "[first] alice: hi")}
+
+	stop()
+
+	// Third is only linked to first, and nothing is linked to third
+	want := []string{"[first] alice: hi", "[third] carol: hello"}
+
+	if got := sender.messages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q relayed, got %q", want, got)
+	}
+}
+
+func TestRelay_FailedSend(t *testing.T) {
+	sender := &fakeSender{err: errors.New("offline")}
+
+	r := NewRelay(sender, "first", "second")
+
+	messages, stop := runRelay(t, r)
+
+	messages <- api.AggregatedMessage{Streamer: "first", StreamMessage: chatMessage("1", "alice", "hi")}
+
+	waitSent(t, sender, 1)
+
+	sender.mu.Lock()
+	sender.err = nil
+	sender.mu.Unlock()
+
+	// It never reached second's chat, so it isn't an echo
+	messages <- api.AggregatedMessage{Streamer: "second", StreamMessage: chatMessage("2", "bob", "[first] alice: hi")}
+
+	stop()
+
+	if got := sender.messages(); len(got) != 2 || got[1] != "[second] bob: [first] alice: hi" {
+		t.Errorf("expected the message relayed after a failed send, got %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// DefaultRosterLimit is how many chatters a Roster keeps, if its Limit is 0
+const DefaultRosterLimit = 5000
+
+// Chatter is what a Roster knows about someone seen in chat
+type Chatter struct {
+	ID          string
+	Username    string
+	Displayname string
+	Avatar      string
+	Role        string // Their role on DLive
+	RoomRole    string // Their role in the streamer's chat, such as api.RoomRoleModerator
+	Subscribing bool
+	Banned      bool      // If they were banned while the roster was watching
+	FirstSeen   time.Time // When they first did something in chat
+	LastSeen    time.Time // When they last did something in chat
+	Messages    int       // How many chat messages they have sent
+}
+
+// Roster keeps track of everyone seen in a streamer's chat
+// Moderator and ban events update the chatter they are about, without counting as them being seen
+// Once it is full, the chatter idle the longest is forgotten to make room for someone new
+type Roster struct {
+	Limit int // Most chatters kept, DefaultRosterLimit if 0
+
+	mu       sync.Mutex
+	chatters map[string]*Chatter // By user ID
+	now      func() time.Time
+}
+
+// NewRoster creates an empty Roster
+func NewRoster() *Roster {
+	return &Roster{
+		chatters: make(map[string]*Chatter),
+		now:      time.Now,
+	}
+}
+
+// HandleMessage updates the roster from a chat event
+func (r *Roster) HandleMessage(m api.StreamMessage) {
+	if m.Sender.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.chatters[m.Sender.ID]
+
+	if !ok {
+		r.evict()
+
+		c = &Chatter{ID: m.Sender.ID}
+		r.chatters[m.Sender.ID] = c
+	}
+
+	// Events about a chatter may not carry all their details, so only replace what is given
+	for _, f := range []struct {
+		field *string
+		value string
+	}{
+		{&c.Username, m.Sender.Username},
+		{&c.Displayname, m.Sender.Displayname},
+		{&c.Avatar, m.Sender.Avatar},
+		{&c.Role, m.Role},
+	} {
+		if f.value != "" {
+			*f.field = f.value
+		}
+	}
+
+	switch m.Type {
+	case api.MessageTypeModerator:
+		if m.Add {
+			c.RoomRole = api.RoomRoleModerator
+		} else {
+			c.RoomRole = api.RoomRoleMember
+		}
+
+		return
+	case api.MessageTypeBan:
+		c.Banned = true
+		return
+	case api.MessageTypeText:
+		c.Messages++
+	}
+
+	c.Subscribing = m.Subscribing || m.Type == api.MessageTypeSubscription
+
+	if m.RoomRole != "" {
+		c.RoomRole = m.RoomRole
+	}
+
+	now := r.now()
+
+	if c.FirstSeen.IsZero() {
+		c.FirstSeen = now
+	}
+
+	c.LastSeen = now
+	c.Banned = false
+}
+
+// Chatter gives what is known about the user with the given ID
+func (r *Roster) Chatter(id string) (Chatter, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.chatters[id]
+
+	if !ok {
+		return Chatter{}, false
+	}
+
+	return *c, true
+}
+
+// Lookup finds a chatter by username, ignoring case
+func (r *Roster) Lookup(username string) (Chatter, bool) {
+	username = strings.TrimPrefix(username, "@")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.chatters {
+		if strings.EqualFold(c.Username, username) {
+			return *c, true
+		}
+	}
+
+	return Chatter{}, false
+}
+
+// Len gives how many chatters are known
+func (r *Roster) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.chatters)
+}
+
+// Active gives the chatters seen within the given duration, most recent first
+func (r *Roster) Active(within time.Duration) []Chatter {
+	since := r.now().Add(-within)
+
+	return r.find(func(c *Chatter) bool {
+		return !c.LastSeen.Before(since)
+	})
+}
+
+// Moderators gives the chatters known to be moderators, most recently seen first
+func (r *Roster) Moderators() []Chatter {
+	return r.find(func(c *Chatter) bool {
+		return c.RoomRole == api.RoomRoleModerator
+	})
+}
+
+// Subscribers gives the chatters known to be subscribed, most recently seen first
+func (r *Roster) Subscribers() []Chatter {
+	return r.find(func(c *Chatter) bool {
+		return c.Subscribing
+	})
+}
+
+// Chatters gives every known chatter, most recently seen first
+func (r *Roster) Chatters() []Chatter {
+	return r.find(func(c *Chatter) bool {
+		return true
+	})
+}
+
+// evict forgets the chatter idle the longest if the roster is full, the lock must be held
+func (r *Roster) evict() {
+	limit := r.Limit
+
+	if limit <= 0 {
+		limit = DefaultRosterLimit
+	}
+
+	if len(r.chatters) < limit {
+		return
+	}
+
+	var oldest *Chatter
+
+	for _, c := range r.chatters {
+		if oldest == nil || c.LastSeen.Before(oldest.LastSeen) {
+			oldest = c
+		}
+	}
+
+	delete(r.chatters, oldest.ID)
+}
+
+func (r *Roster) find(keep func(c *Chatter) bool) []Chatter {
+	r.mu.Lock()
+
+	var found []Chatter
+
+	for _, c := range r.chatters {
+		if keep(c) {
+			found = append(found, *c)
+		}
+	}
+
+	r.mu.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].LastSeen.Equal(found[j].LastSeen) {
+			return found[i].LastSeen.After(found[j].LastSeen)
+		}
+
+		return found[i].ID < found[j].ID
+	})
+
+	return found
+}
+
+// Rosters keeps a Roster for each streamer's chat, for bots in more than one chat through an api.Aggregator
+type Rosters struct {
+	mu      sync.Mutex
+	rosters map[string]*Roster
+}
+
+// NewRosters creates an empty Rosters
+func NewRosters() *Rosters {
+	return &Rosters{rosters: make(map[string]*Roster)}
+}
+
+// HandleMessage updates the roster of the streamer whose chat the event came from
+func (r *Rosters) HandleMessage(m api.AggregatedMessage) {
+	r.Roster(m.Streamer).HandleMessage(m.StreamMessage)
+}
+
+// Roster gives the streamer's roster, creating it if needed
+func (r *Rosters) Roster(streamer string) *Roster {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	roster, ok := r.rosters[streamer]
+
+	if !ok {
+		roster = NewRoster()
+		r.rosters[streamer] = roster
+	}
+
+	return roster
+}
@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+func TestRoster(t *testing.T) {
+	clock := newFakeClock()
+
+	r := NewRoster()
+	r.Limit = 3
+	r.now = clock.Now
+
+	mod := chatMessage("1", "Alice", "hi")
+	mod.RoomRole = api.RoomRoleModerator
+
+	sub := chatMessage("2", "bob", "hello")
+	sub.Subscribing = true
+
+	r.HandleMessage(mod)
+	clock.Advance(time.Minute)
+	r.HandleMessage(sub)
+	clock.Advance(time.Minute)
+	r.HandleMessage(chatMessage("3", "carol", "hey"))
+
+	if c, ok := r.Lookup("@ALICE"); !ok || c.ID != "1" || c.Messages != 1 {
+		t.Errorf("expected to find alice ignoring case, got %+v", c)
+	}
+
+	if _, ok := r.Lookup("dave"); ok {
+		t.Error("expected nobody found for an unknown username")
+	}
+
+	if active := r.Active(time.Minute); len(active) != 2 || active[0].ID != "3" || active[1].ID != "2" {
+		t.Errorf("expected carol then bob active, got %+v", active)
+	}
+
+	if mods := r.Moderators(); len(mods) != 1 || mods[0].ID != "1" {
+		t.Errorf("expected alice as the only moderator, got %+v", mods)
+	}
+
+	if subs := r.Subscribers(); len(subs) != 1 || subs[0].ID != "2" {
+		t.Errorf("expected bob as the only subscriber, got %+v", subs)
+	}
+
+	// Ban events don't count as being seen
+	clock.Advance(time.Minute)
+	r.HandleMessage(api.StreamMessage{Type: api.MessageTypeBan, Sender: api.Sender{ID: "1"}})
+
+	if c, _ := r.Chatter("1"); !c.Banned || !c.LastSeen.Equal(c.FirstSeen) {
+		t.Errorf("expected alice banned without being seen, got %+v", c)
+	}
+
+	// The roster is full, so alice, idle the longest, is forgotten
+	r.HandleMessage(chatMessage("4", "dave", "yo"))
+
+	if _, ok := r.Chatter("1"); ok || r.Len() != 3 {
+		t.Errorf("expected alice forgotten to keep 3 chatters, have %d", r.Len())
+	}
+}
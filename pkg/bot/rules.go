@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// Rule decides if a chat message breaks a moderation policy
+// Rules are used from many goroutines, ones that track chatters over time must lock their own state
+type Rule interface {
+	Name() string
+	Check(m api.StreamMessage, now time.Time) bool
+}
+
+// emotePattern matches emotes in chat text, which DLive sends as :emote/<level>/<owner>/<name>:
+var emotePattern = regexp.MustCompile(`:emote/[^:\s]+:`)
+
+// linkPattern matches web addresses, with or without a scheme
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://)?((?:[a-z0-9-]+\.)+[a-z]{2,})(?:[:/]\S*)?`)
+
+// BannedWords breaks on messages containing any of the words, ignoring case
+// Words only match whole words, so "ass" doesn't match "class"
+type BannedWords struct {
+	Words []string
+}
+
+func (r *BannedWords) Name() string {
+	return "banned words"
+}
+
+func (r *BannedWords) Check(m api.StreamMessage, now time.Time) bool {
+	words := strings.FieldsFunc(strings.ToLower(m.Content), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+
+	for _, w := range words {
+		for _, banned := range r.Words {
+			if w == strings.ToLower(banned) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// BannedPatterns breaks on messages matching any of the regular expressions
+type BannedPatterns struct {
+	Patterns []*regexp.Regexp
+}
+
+// NewBannedPatterns compiles the expressions into a BannedPatterns rule
+func NewBannedPatterns(exprs ...string) (*BannedPatterns, error) {
+	r := &BannedPatterns{}
+
+	for _, expr := range exprs {
+		p, err := regexp.Compile(expr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.Patterns = append(r.Patterns, p)
+	}
+
+	return r, nil
+}
+
+func (r *BannedPatterns) Name() string {
+	return "banned patterns"
+}
+
+func (r *BannedPatterns) Check(m api.StreamMessage, now time.Time) bool {
+	for _, p := range r.Patterns {
+		if p.MatchString(m.Content) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Links breaks on messages containing links to any site not allowed
+type Links struct {
+	Allowed []string // Domains that may be linked, including their subdomains, such as dlive.tv
+}
+
+func (r *Links) Name() string {
+	return "links"
+}
+
+func (r *Links) Check(m api.StreamMessage, now time.Time) bool {
+	content := emotePattern.ReplaceAllString(m.Content, " ")
+
+	for _, match := range linkPattern.FindAllStringSubmatch(content, -1) {
+		if !r.allowed(strings.ToLower(match[1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Links) allowed(host string) bool {
+	for _, domain := range r.Allowed {
+		domain = strings.ToLower(domain)
+
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Caps breaks on messages with too many capital letters
+type Caps struct {
+	MinLetters int     // Messages with fewer letters than this are never broken
+	MaxRatio   float64 // Highest share of letters that may be capitals, between 0 and 1
+}
+
+func (r *Caps) Name() string {
+	return "caps"
+}
+
+func (r *Caps) Check(m api.StreamMessage, now time.Time) bool {
+	letters, upper := 0, 0
+
+	for _, c := range emotePattern.ReplaceAllString(m.Content, "") {
+		if unicode.IsLetter(c) {
+			letters++
+
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+
+	if letters == 0 || letters < r.MinLetters {
+		return false
+	}
+
+	return float64(upper)/float64(letters) > r.MaxRatio
+}
+
+// Emotes breaks on messages with more than Max emotes
+type Emotes struct {
+	Max int
+}
+
+func (r *Emotes) Name() string {
+	return "emote spam"
+}
+
+func (r *Emotes) Check(m api.StreamMessage, now time.Time) bool {
+	return len(emotePattern.FindAllStringIndex(m.Content, -1)) > r.Max
+}
+
+// Repeats breaks when a chatter sends the same message more than Max times within Window
+// Messages are compared ignoring case and surrounding space
+type Repeats struct {
+	Max    int
+	Window time.Duration
+
+	tracker chatterTracker
+}
+
+func (r *Repeats) Name() string {
+	return "repeated messages"
+}
+
+func (r *Repeats) Check(m api.StreamMessage, now time.Time) bool {
+	content := strings.ToLower(strings.TrimSpace(m.Content))
+
+	return r.tracker.record(m.Sender.ID+"\x00"+content, now, r.Window) > r.Max
+}
+
+// Flood breaks when a chatter sends more than Max messages within Window
+type Flood struct {
+	Max    int
+	Window time.Duration
+
+	tracker chatterTracker
+}
+
+func (r *Flood) Name() string {
+	return "message flood"
+}
+
+func (r *Flood) Check(m api.StreamMessage, now time.Time) bool {
+	return r.tracker.record(m.Sender.ID, now, r.Window) > r.Max
+}
+
+// chatterSweepSize is how many keys a chatterTracker holds before it drops the ones with nothing recent
+const chatterSweepSize = 1024
+
+// chatterTracker counts recent events by key, for rules that look at what chatters did over time
+type chatterTracker struct {
+	mu     sync.Mutex
+	events map[string][]time.Time
+	sweep  int // Number of keys that triggers the next sweep
+}
+
+// record adds an event for the key, returning how many it has had within the window
+func (t *chatterTracker) record(key string, now time.Time, window time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.events == nil {
+		t.events = make(map[string][]time.Time)
+		t.sweep = chatterSweepSize
+	}
+
+	events := append(recent(t.events[key], now, window), now)
+	t.events[key] = events
+
+	if len(t.events) >= t.sweep {
+		for k, v := range t.events {
+			if v = recent(v, now, window); len(v) == 0 {
+				delete(t.events, k)
+			} else {
+				t.events[k] = v
+			}
+		}
+
+		t.sweep = 2 * len(t.events)
+
+		if t.sweep < chatterSweepSize {
+			t.sweep = chatterSweepSize
+		}
+	}
+
+	return len(events)
+}
+
+// recent drops the times that are older than the window, times must be in order
+func recent(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+
+	return times[i:]
+}
@@ -0,0 +1,97 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+// StreamInfoClient looks up a streamer's channel, an *api.Client satisfies it
+type StreamInfoClient interface {
+	LivestreamPage(args api.LivestreamPageArgs) (api.Response, error)
+}
+
+// StreamInfo is a snapshot of a streamer's channel
+type StreamInfo struct {
+	Live      bool
+	Title     string    // Title of the current stream
+	Viewers   int64     // How many are watching the current stream
+	StartedAt time.Time // When the current stream started, zero if unknown
+	Followers int64
+}
+
+// Uptime gives how long the stream has been live, 0 if it is offline or the start is unknown
+func (s StreamInfo) Uptime(now time.Time) time.Duration {
+	if !s.Live || s.StartedAt.IsZero() {
+		return 0
+	}
+
+	return now.Sub(s.StartedAt)
+}
+
+// FetchStreamInfo looks up the channel of the streamer with the given display name
+func FetchStreamInfo(client StreamInfoClient, displayname string) (StreamInfo, error) {
+	resp, err := client.LivestreamPage(api.LivestreamPageArgs{DisplayName: displayname})
+
+	if err != nil {
+		return StreamInfo{}, err
+	}
+
+	user, ok := resp.Data["userByDisplayName"].(map[string]interface{})
+
+	if !ok {
+		return StreamInfo{}, fmt.Errorf("no user found with displayname (%s)", displayname)
+	}
+
+	var info StreamInfo
+
+	if followers, ok := user["followers"].(map[string]interface{}); ok {
+		info.Followers = int64(number(followers["totalCount"]))
+	}
+
+	stream, ok := user["livestream"].(map[string]interface{})
+
+	if !ok {
+		return info, nil
+	}
+
+	info.Live = true
+	info.Title, _ = stream["title"].(string)
+	info.Viewers = int64(number(stream["watchingCount"]))
+
+	// DLive gives times as milliseconds since the epoch
+	if ms := number(stream["createdAt"]); ms > 0 {
+		info.StartedAt = time.Unix(0, int64(ms)*int64(time.Millisecond))
+	}
+
+	return info, nil
+}
+
+// number reads a JSON number that may have been sent as a string
+func number(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		f, _ := strconv.ParseFloat(n, 64)
+		return f
+	}
+
+	return 0
+}
+
+// formatDuration writes a duration the way chat would, such as 2h 5m
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+
+	if h == 0 {
+		return fmt.Sprintf("%dm", m)
+	}
+
+	return fmt.Sprintf("%dh %dm", h, m)
+}
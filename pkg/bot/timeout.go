@@ -0,0 +1,581 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+const unbanStreamChatUserField = "streamchatUserUnban"
+
+// timeoutCheckInterval is how often a running Timeouts checks for expired timeouts
+const timeoutCheckInterval = time.Second
+
+// DefaultMaxUnbanAttempts is how many times a Timeouts tries an unban DLive refuses before giving up, if its MaxUnbanAttempts is 0
+const DefaultMaxUnbanAttempts = 10
+
+// Failed unbans are tried again after timeoutRetryDelay, doubling with each attempt up to timeoutMaxRetryDelay
+const (
+	timeoutRetryDelay    = 30 * time.Second
+	timeoutMaxRetryDelay = 30 * time.Minute
+)
+
+// ErrNoTimeout is given when a user has no pending timeout
+var ErrNoTimeout = errors.New("no timeout pending for that user")
+
+// TimeoutClient bans and unbans users in a streamer's chat, an *api.Client satisfies it
+type TimeoutClient interface {
+	BanStreamChatUser(args api.BanStreamChatUserArgs) (api.Response, error)
+	UnbanStreamChatUser(args api.UnbanStreamChatUserArgs) (api.Response, error)
+}
+
+// Timeout is a ban waiting to be lifted
+type Timeout struct {
+	Streamer string    `json:"streamer"`
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	Start    time.Time `json:"start"`
+	Until    time.Time `json:"until"`              // When the user is unbanned
+	Attempts int       `json:"attempts,omitempty"` // Failed unbans so far
+	Retry    time.Time `json:"retry,omitempty"`    // When a failed unban is tried again
+}
+
+// timeoutFile is the layout of the file a Timeouts saves to
+type timeoutFile struct {
+	Timeouts []Timeout `json:"timeouts"`
+	Failed   []Timeout `json:"failed,omitempty"`
+}
+
+// Timeouts bans users from a streamer's chat for a while, unbanning them once their time is up
+// Pending unbans are saved to a JSON file, so they are still made after a restart
+// Failed unbans are tried again with a growing delay, and only given up on once DLive has refused MaxUnbanAttempts of them,
+// which leaves the user banned until a moderator lifts it, see Failed
+type Timeouts struct {
+	Client           TimeoutClient
+	Audit            *ModerationLog              // Given the reasons for bans and unbans, if set
+	Logger           api.Logger                  // Where failed unbans are reported, silent if nil
+	MaxUnbanAttempts int                         // Attempts before an unban DLive refuses is given up on, DefaultMaxUnbanAttempts if 0
+	OnFailed         func(to Timeout, err error) // Called when an unban is given up on, if set
+
+	path    string
+	mu      sync.Mutex
+	pending map[string]*Timeout // By streamer and lower case username
+	failed  map[string]*Timeout // Timeouts whose unban was given up on, by streamer and lower case username
+	now     func() time.Time
+}
+
+// NewTimeouts creates a Timeouts saving pending unbans to the file at path, loading any already in it
+// If path is empty they are kept in memory only
+func NewTimeouts(client TimeoutClient, path string) (*Timeouts, error) {
+	t := &Timeouts{
+		Client:  client,
+		path:    path,
+		pending: make(map[string]*Timeout),
+		failed:  make(map[string]*Timeout),
+		now:     time.Now,
+	}
+
+	if path == "" {
+		return t, nil
+	}
+
+	b, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var f timeoutFile
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("unable to read timeouts from (%s): %w", path, err)
+	}
+
+	for i := range f.Timeouts {
+		to := f.Timeouts[i]
+		t.pending[timeoutKey(to.Streamer, to.Username)] = &to
+	}
+
+	for i := range f.Failed {
+		to := f.Failed[i]
+		t.failed[timeoutKey(to.Streamer, to.Username)] = &to
+	}
+
+	return t, nil
+}
+
+// Timeout bans the user from the streamer's chat, scheduling the unban after the duration
+// Timing out a user who already has a timeout replaces when they are unbanned
+func (t *Timeouts) Timeout(streamer string, username string, d time.Duration, reason string) (Timeout, error) {
+	username = strings.TrimPrefix(username, "@")
+
+	if d <= 0 {
+		return Timeout{}, fmt.Errorf("invalid timeout duration (%s)", d)
+	}
+
+	t.mu.Lock()
+
+	now := t.now()
+
+	to := &Timeout{
+		Streamer: streamer,
+		Username: username,
+		Reason:   reason,
+		Start:    now,
+		Until:    now.Add(d),
+	}
+
+	// The unban is saved before the ban is made, so a crash in between can't leave the user banned for good
+	key := timeoutKey(streamer, username)
+	previous, failed := t.pending[key], t.failed[key]
+
+	t.pending[key] = to
+	delete(t.failed, key)
+
+	if err := t.save(); err != nil {
+		t.restore(key, to, previous, failed)
+		t.mu.Unlock()
+
+		return Timeout{}, err
+	}
+
+	t.mu.Unlock()
+
+	if t.Audit != nil {
+		t.Audit.NoteReason(ModActionBan, username, timeoutReason(d, reason))
+	}
+
+	resp, err := t.Client.BanStreamChatUser(api.BanStreamChatUserArgs{
+		Streamer: streamer,
+		Username: username,
+	})
+
+	if err == nil {
+		err = resp.MutationError(banStreamChatUserField)
+	}
+
+	if err != nil {
+		if t.Audit != nil {
+			t.Audit.ForgetReason(ModActionBan, username)
+		}
+
+		t.mu.Lock()
+		t.restore(key, to, previous, failed)
+		saveErr := t.save()
+		t.mu.Unlock()
+
+		if saveErr != nil {
+			logger(t.Logger).Warn("unable to save timeouts", "error", saveErr)
+		}
+
+		return Timeout{}, err
+	}
+
+	return *to, nil
+}
+
+// Pending gives the timeouts waiting to be lifted, soonest first
+func (t *Timeouts) Pending() []Timeout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return sortTimeouts(t.pending)
+}
+
+// Failed gives the timeouts whose unban was given up on, soonest first
+// Those users stay banned until a moderator lifts or cancels their timeout
+func (t *Timeouts) Failed() []Timeout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return sortTimeouts(t.failed)
+}
+
+// Cancel drops the user's pending or failed unban, leaving them banned
+func (t *Timeouts) Cancel(streamer string, username string) (Timeout, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := timeoutKey(streamer, username)
+	to, ok := t.pending[key]
+
+	if !ok {
+		to, ok = t.failed[key]
+	}
+
+	if !ok {
+		return Timeout{}, ErrNoTimeout
+	}
+
+	delete(t.pending, key)
+	delete(t.failed, key)
+
+	return *to, t.save()
+}
+
+// Lift unbans the user now, ending their timeout early or trying again one that was given up on
+func (t *Timeouts) Lift(streamer string, username string) (Timeout, error) {
+	key := timeoutKey(streamer, username)
+
+	t.mu.Lock()
+	found, ok := t.pending[key]
+
+	if !ok {
+		found, ok = t.failed[key]
+	}
+
+	var to Timeout
+
+	if ok {
+		to = *found
+	}
+
+	t.mu.Unlock()
+
+	if !ok {
+		return Timeout{}, ErrNoTimeout
+	}
+
+	return to, t.unban(to, "timeout lifted early")
+}
+
+// Expire unbans everyone whose timeout is up, returning the first error
+// Failed unbans stay pending and are tried again after a delay that grows with each attempt
+func (t *Timeouts) Expire() error {
+	now := t.now()
+
+	var due []Timeout
+
+	for _, to := range t.Pending() {
+		if to.Until.After(now) {
+			break
+		}
+
+		if to.Retry.After(now) {
+			continue
+		}
+
+		due = append(due, to)
+	}
+
+	var first error
+
+	for _, to := range due {
+		err := t.unban(to, "timeout expired")
+
+		if err == nil {
+			continue
+		}
+
+		t.retry(to, err)
+
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Run unbans users as their timeouts end, until the context is done
+// Timeouts that ended while the program wasn't running are lifted straight away
+func (t *Timeouts) Run(ctx context.Context) error {
+	tick := time.NewTicker(timeoutCheckInterval)
+	defer tick.Stop()
+
+	_ = t.Expire()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+			_ = t.Expire()
+		}
+	}
+}
+
+// Register adds the timeout commands to the router, for the streamer of the router's chat
+func (t *Timeouts) Register(r *Router) error {
+	commands := []Command{
+		{
+			Name:        "timeout",
+			Description: "Bans a viewer for a while, such as !timeout user 10m reason",
+			Permission:  PermissionModerator,
+			Handler:     t.timeoutCommand,
+		},
+		{
+			Name:        "untimeout",
+			Description: "Ends a viewer's timeout early",
+			Permission:  PermissionModerator,
+			Handler:     t.untimeoutCommand,
+		},
+		{
+			Name:        "timeouts",
+			Description: "Lists the viewers timed out",
+			Permission:  PermissionModerator,
+			Cooldown:    10 * time.Second,
+			Handler:     t.listCommand,
+		},
+	}
+
+	for _, c := range commands {
+		if err := r.Handle(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Timeouts) timeoutCommand(c *CommandContext) error {
+	d, err := parseTimeoutDuration(c.Arg(1))
+
+	if c.Arg(0) == "" || err != nil || d <= 0 {
+		return c.Reply(fmt.Sprintf("Usage: %s <user> <duration> [reason]", c.Name))
+	}
+
+	to, err := t.Timeout(c.Chat.Streamer, c.Arg(0), d, strings.Join(c.Args[2:], " "))
+
+	if err != nil {
+		return err
+	}
+
+	return c.Reply(fmt.Sprintf("%s is timed out for %s", to.Username, d))
+}
+
+func (t *Timeouts) untimeoutCommand(c *CommandContext) error {
+	to, err := t.Lift(c.Chat.Streamer, c.Arg(0))
+
+	if err == ErrNoTimeout {
+		return c.Reply(fmt.Sprintf("%s isn't timed out", c.Arg(0)))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.Reply(fmt.Sprintf("%s's timeout has ended", to.Username))
+}
+
+func (t *Timeouts) listCommand(c *CommandContext) error {
+	now := t.now()
+
+	var parts []string
+
+	for _, to := range t.Pending() {
+		if to.Streamer == c.Chat.Streamer {
+			parts = append(parts, fmt.Sprintf("%s (%s)", to.Username, to.Until.Sub(now).Round(time.Second)))
+		}
+	}
+
+	for _, to := range t.Failed() {
+		if to.Streamer == c.Chat.Streamer {
+			parts = append(parts, fmt.Sprintf("%s (unban failed)", to.Username))
+		}
+	}
+
+	if len(parts) == 0 {
+		return c.Reply("Nobody is timed out")
+	}
+
+	return c.Reply("Timed out: " + strings.Join(parts, ", "))
+}
+
+// unban lifts the ban, then forgets the timeout
+func (t *Timeouts) unban(to Timeout, reason string) error {
+	if t.Audit != nil {
+		t.Audit.NoteReason(ModActionUnban, to.Username, reason)
+	}
+
+	resp, err := t.Client.UnbanStreamChatUser(api.UnbanStreamChatUserArgs{
+		Streamer: to.Streamer,
+		Username: to.Username,
+	})
+
+	if err == nil {
+		err = resp.MutationError(unbanStreamChatUserField)
+	}
+
+	if err != nil {
+		if t.Audit != nil {
+			t.Audit.ForgetReason(ModActionUnban, to.Username)
+		}
+
+		return err
+	}
+
+	return t.forget(to)
+}
+
+// restore puts back what the user had before the timeout, unless it was replaced meanwhile, the lock must be held
+func (t *Timeouts) restore(key string, to *Timeout, previous *Timeout, failed *Timeout) {
+	if t.pending[key] != to {
+		return
+	}
+
+	delete(t.pending, key)
+
+	if previous != nil {
+		t.pending[key] = previous
+	}
+
+	if failed != nil {
+		t.failed[key] = failed
+	}
+}
+
+// retry schedules the timeout's failed unban to be tried again, giving up once DLive has refused too many attempts
+func (t *Timeouts) retry(to Timeout, err error) {
+	t.mu.Lock()
+
+	key := timeoutKey(to.Streamer, to.Username)
+	current, ok := t.pending[key]
+
+	// Replaced or lifted meanwhile
+	if !ok || !current.Until.Equal(to.Until) {
+		t.mu.Unlock()
+		return
+	}
+
+	current.Attempts++
+
+	limit := t.MaxUnbanAttempts
+
+	if limit <= 0 {
+		limit = DefaultMaxUnbanAttempts
+	}
+
+	var refused *api.MutationError
+
+	// Only refusals count towards giving up, an unban that never reached DLive says nothing about the next one
+	giveUp := errors.As(err, &refused) && current.Attempts >= limit
+
+	if giveUp {
+		delete(t.pending, key)
+		t.failed[key] = current
+	} else {
+		delay := timeoutRetryDelay
+
+		for i := 1; i < current.Attempts && delay < timeoutMaxRetryDelay; i++ {
+			delay *= 2
+		}
+
+		if delay > timeoutMaxRetryDelay {
+			delay = timeoutMaxRetryDelay
+		}
+
+		current.Retry = t.now().Add(delay)
+	}
+
+	failed := *current
+	saveErr := t.save()
+
+	t.mu.Unlock()
+
+	if saveErr != nil {
+		logger(t.Logger).Warn("unable to save timeouts", "error", saveErr)
+	}
+
+	if !giveUp {
+		logger(t.Logger).Warn("unable to end timeout", "streamer", to.Streamer, "username", to.Username, "attempts", failed.Attempts, "retry", failed.Retry, "error", err)
+		return
+	}
+
+	logger(t.Logger).Error("giving up on ending timeout, user stays banned", "streamer", to.Streamer, "username", to.Username, "attempts", failed.Attempts, "error", err)
+
+	if t.OnFailed != nil {
+		t.OnFailed(failed, err)
+	}
+}
+
+// forget drops the timeout if it hasn't been replaced meanwhile
+func (t *Timeouts) forget(to Timeout) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := timeoutKey(to.Streamer, to.Username)
+
+	if current, ok := t.pending[key]; ok && current.Until.Equal(to.Until) {
+		delete(t.pending, key)
+	}
+
+	if current, ok := t.failed[key]; ok && current.Until.Equal(to.Until) {
+		delete(t.failed, key)
+	}
+
+	return t.save()
+}
+
+// save writes the pending timeouts to the file, the lock must be held
+func (t *Timeouts) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	f := timeoutFile{
+		Timeouts: sortTimeouts(t.pending),
+		Failed:   sortTimeouts(t.failed),
+	}
+
+	b, err := json.Marshal(f)
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(t.path, b)
+}
+
+// sortTimeouts copies the timeouts, soonest first
+func sortTimeouts(m map[string]*Timeout) []Timeout {
+	timeouts := make([]Timeout, 0, len(m))
+
+	for _, to := range m {
+		timeouts = append(timeouts, *to)
+	}
+
+	sort.Slice(timeouts, func(i, j int) bool {
+		if !timeouts[i].Until.Equal(timeouts[j].Until) {
+			return timeouts[i].Until.Before(timeouts[j].Until)
+		}
+
+		return timeouts[i].Username < timeouts[j].Username
+	})
+
+	return timeouts
+}
+
+func timeoutKey(streamer string, username string) string {
+	return streamer + "\x00" + strings.ToLower(strings.TrimPrefix(username, "@"))
+}
+
+func timeoutReason(d time.Duration, reason string) string {
+	if reason == "" {
+		return "timeout for " + d.String()
+	}
+
+	return "timeout for " + d.String() + ": " + reason
+}
+
+// parseTimeoutDuration reads a duration such as 10m, or a number of seconds
+func parseTimeoutDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,285 @@
+package bot
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dak425/dlive/pkg/api"
+)
+
+type fakeBanClient struct {
+	banned   []string
+	unbanned []string
+	err      error        // Given by unbans
+	banErr   error        // Given by bans
+	resp     api.Response // Given by unbans
+}
+
+func (f *fakeBanClient) BanStreamChatUser(args api.BanStreamChatUserArgs) (api.Response, error) {
+	if f.banErr != nil {
+		return api.Response{}, f.banErr
+	}
+
+	f.banned = append(f.banned, args.Username)
+	return api.Response{}, nil
+}
+
+func (f *fakeBanClient) UnbanStreamChatUser(args api.UnbanStreamChatUserArgs) (api.Response, error) {
+	if f.err != nil {
+		return api.Response{}, f.err
+	}
+
+	f.unbanned = append(f.unbanned, args.Username)
+	return f.resp, nil
+}
+
+func TestTimeouts(t *testing.T) {
+	clock := newFakeClock()
+	client := &fakeBanClient{}
+	path := filepath.Join(t.TempDir(), "timeouts.json")
+
+	timeouts, err := NewTimeouts(client, path)
+
+	if err != nil {
+		t.Fatalf("failed to create timeouts: %s", err)
+	}
+
+	timeouts.now = clock.Now
+
+	for _, to := range []struct {
+		username string
+		d        time.Duration
+	}{
+		{"@spammer", 10 * time.Minute},
+		{"troll", time.Minute},
+		{"lurker", time.Hour},
+	} {
+		if _, err := timeouts.Timeout("streamer", to.username, to.d, "spam"); err != nil {
+			t.Fatalf("failed to time out %s: %s", to.username, err)
+		}
+	}
+
+	if _, err := timeouts.Cancel("streamer", "LURKER"); err != nil {
+		t.Fatalf("failed to cancel timeout: %s", err)
+	}
+
+	// Pending unbans survive a restart
+	timeouts, err = NewTimeouts(client, path)
+
+	if err != nil {
+		t.Fatalf("failed to load timeouts: %s", err)
+	}
+
+	timeouts.now = clock.Now
+
+	pending := timeouts.Pending()
+
+	if len(pending) != 2 || pending[0].Username != "troll" || pending[1].Username != "spammer" {
+		t.Fatalf("expected troll then spammer pending, got %+v", pending)
+	}
+
+	clock.Advance(5 * time.Minute)
+	client.err = errors.New("offline")
+
+	if err := timeouts.Expire(); err == nil || len(timeouts.Pending()) != 2 {
+		t.Fatalf("expected a failed unban to stay pending, got %v", err)
+	}
+
+	client.err = nil
+
+	// Not tried again until the delay is up
+	if err := timeouts.Expire(); err != nil || len(client.unbanned) != 0 {
+		t.Fatalf("expected the failed unban to wait before trying again, got %v", client.unbanned)
+	}
+
+	clock.Advance(timeoutRetryDelay)
+
+	if err := timeouts.Expire(); err != nil {
+		t.Fatalf("failed to expire timeouts: %s", err)
+	}
+
+	if len(client.unbanned) != 1 || client.unbanned[0] != "troll" || len(timeouts.Pending()) != 1 {
+		t.Errorf("expected only troll unbanned, got %v", client.unbanned)
+	}
+
+	if _, err := timeouts.Lift("streamer", "spammer"); err != nil || len(timeouts.Pending()) != 0 {
+		t.Errorf("expected spammer's timeout lifted, got %v", err)
+	}
+}
+
+func TestTimeouts_Failures(t *testing.T) {
+	clock := newFakeClock()
+	client := &fakeBanClient{}
+	dir := t.TempDir()
+	audit := NewModerationLog(filepath.Join(dir, "moderation.jsonl"), "streamer")
+
+	// Nowhere to save the unban, so the ban must not be made
+	unsaved, _ := NewTimeouts(client, filepath.Join(dir, "missing", "timeouts.json"))
+
+	if _, err := unsaved.Timeout("streamer", "troll", time.Minute, "spam"); err == nil || len(client.banned) != 0 {
+		t.Fatalf("expected no ban without a saved unban, got %v and %v", err, client.banned)
+	}
+
+	path := filepath.Join(dir, "timeouts.json")
+	timeouts, _ := NewTimeouts(client, path)
+	timeouts.Audit = audit
+	timeouts.now = clock.Now
+
+	if _, err := timeouts.Timeout("streamer", "troll", time.Hour, "spam"); err != nil {
+		t.Fatalf("failed to time out troll: %s", err)
+	}
+
+	client.banErr = errors.New("offline")
+
+	if _, err := timeouts.Timeout("streamer", "troll", time.Minute, "spam"); err == nil {
+		t.Fatal("expected the timeout to fail with the ban")
+	}
+
+	// The unban saved before the failed ban is taken back, leaving the earlier timeout
+	reloaded, _ := NewTimeouts(client, path)
+
+	if pending := reloaded.Pending(); len(pending) != 1 || !pending[0].Until.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("expected only the earlier timeout saved, got %+v", pending)
+	}
+
+	if _, err := timeouts.Cancel("streamer", "troll"); err != nil {
+		t.Fatalf("failed to cancel timeout: %s", err)
+	}
+
+	// A reason left behind would be given to the next ban of troll, whatever it was for
+	audit.mu.Lock()
+	left := len(audit.reasons)
+	audit.mu.Unlock()
+
+	if left != 0 {
+		t.Errorf("expected the failed ban's reason forgotten, %d left", left)
+	}
+
+	client.banErr = nil
+	client.resp = api.Response{Data: map[string]interface{}{
+		unbanStreamChatUserField: map[string]interface{}{"err": map[string]interface{}{"code": float64(1)}},
+	}}
+
+	if _, err := timeouts.Timeout("streamer", "troll", time.Minute, "spam"); err != nil {
+		t.Fatalf("failed to time out troll: %s", err)
+	}
+
+	timeouts.MaxUnbanAttempts = 3
+
+	var gaveUp []Timeout
+
+	timeouts.OnFailed = func(to Timeout, err error) {
+		gaveUp = append(gaveUp, to)
+	}
+
+	clock.Advance(time.Minute)
+
+	var refused *api.MutationError
+
+	// A refusal may be a rate limit, so it is tried again with a growing delay rather than leaving troll banned
+	for i, delay := range []time.Duration{timeoutRetryDelay, 2 * timeoutRetryDelay} {
+		if err := timeouts.Expire(); !errors.As(err, &refused) {
+			t.Fatalf("attempt %d: expected the unban refused, got %v", i+1, err)
+		}
+
+		pending := timeouts.Pending()
+
+		if len(pending) != 1 || pending[0].Attempts != i+1 || !pending[0].Retry.Equal(clock.Now().Add(delay)) {
+			t.Fatalf("attempt %d: expected the timeout kept and tried again in %s, got %+v", i+1, delay, pending)
+		}
+
+		clock.Advance(delay)
+	}
+
+	if err := timeouts.Expire(); !errors.As(err, &refused) {
+		t.Fatalf("expected the last attempt refused, got %v", err)
+	}
+
+	if len(timeouts.Pending()) != 0 || len(timeouts.Failed()) != 1 || len(gaveUp) != 1 || gaveUp[0].Attempts != 3 {
+		t.Fatalf("expected the timeout given up on after 3 attempts, got %+v and %+v", timeouts.Pending(), gaveUp)
+	}
+
+	client.resp = api.Response{}
+
+	// A moderator can still lift it
+	if _, err := timeouts.Lift("streamer", "troll"); err != nil || len(timeouts.Failed()) != 0 {
+		t.Errorf("expected the failed timeout lifted, got %v", err)
+	}
+}
+
+func TestTimeouts_Commands(t *testing.T) {
+	sender := &fakeSender{}
+	clock := newFakeClock()
+	client := &fakeBanClient{}
+
+	r := newTestRouter(sender, clock)
+
+	timeouts, _ := NewTimeouts(client, "")
+	timeouts.now = clock.Now
+
+	if err := timeouts.Register(r); err != nil {
+		t.Fatalf("failed to register timeout commands: %s", err)
+	}
+
+	moderator := func(content string) api.StreamMessage {
+		m := chatMessage("1", "mod", content)
+		m.RoomRole = api.RoomRoleModerator
+
+		return m
+	}
+
+	for _, m := range []api.StreamMessage{
+		chatMessage("2", "viewer", "!timeout troll 10m"), // Only moderators can time out
+		moderator("!timeout troll"),
+		moderator("!timeout troll soon"),
+		moderator("!timeout @troll 10m being rude"),
+		moderator("!timeouts"),
+		moderator("!untimeout troll"),
+		moderator("!untimeout troll"),
+		moderator("!timeouts"),
+	} {
+		r.HandleMessage(m)
+	}
+
+	want := []string{
+		"Usage: timeout <user> <duration> [reason]",
+		"Usage: timeout <user> <duration> [reason]",
+		"troll is timed out for 10m0s",
+		"Timed out: troll (10m0s)",
+		"troll's timeout has ended",
+		"troll isn't timed out",
+		"Nobody is timed out",
+	}
+
+	if got := sender.messages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected replies %q, got %q", want, got)
+	}
+
+	if len(client.banned) != 1 || len(client.unbanned) != 1 {
+		t.Errorf("expected troll banned and unbanned once, got %v and %v", client.banned, client.unbanned)
+	}
+}
+
+func TestParseTimeoutDuration(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"90", 90 * time.Second, true},
+		{"10m", 10 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"-5", -5 * time.Second, true}, // Parsed, but refused by the command
+		{"soon", 0, false},
+		{"", 0, false},
+	} {
+		d, err := parseTimeoutDuration(test.in)
+
+		if (err == nil) != test.ok || d != test.want {
+			t.Errorf("parse %q: expected %s (ok %v), got %s (%v)", test.in, test.want, test.ok, d, err)
+		}
+	}
+}